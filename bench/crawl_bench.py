@@ -0,0 +1,123 @@
+"""Crawl benchmark for valradar and the regex plugin.
+
+Generates a synthetic site, crawls it over http and from disk with every
+concurrency given and prints one JSON line per run with the throughput and the
+time spent per plugin hook, as reported by --hook-timings.
+
+    cargo build --release
+    python3 bench/crawl_bench.py --pages 500 --concurrency 1 4 16 --latency 20
+"""
+
+import argparse
+import json
+import os
+import re
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+from functools import partial
+from http.server import SimpleHTTPRequestHandler, ThreadingHTTPServer
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+PATTERN = "aws=AKIA[0-9A-Z]{16}"
+SUMMARY = re.compile(r"^SUMMARY collected=(\d+) results=(\d+) errors=(\d+) duration=([\d.]+)s")
+HOOK = re.compile(r"^HOOK name=(\S+) calls=(\d+) total=([\d.]+)s mean=([\d.]+)ms")
+
+def generate_site(directory, pages, secret_every):
+    """An index linking to every page, every `secret_every`th page holds a key"""
+    links = []
+    for number in range(pages):
+        name = "page-%d.html" % number
+        links.append("<a href='%s'>%d</a>" % (name, number))
+        secret = "AKIA%016d" % number if secret_every and number % secret_every == 0 else ""
+        with open(os.path.join(directory, name), "w") as page:
+            page.write("<html><body><p>%s</p><p>%s</p></body></html>" % ("filler text " * 50, secret))
+    with open(os.path.join(directory, "index.html"), "w") as index:
+        index.write("<html><body>%s</body></html>" % "\n".join(links))
+
+class SlowHandler(SimpleHTTPRequestHandler):
+    latency = 0
+
+    def do_GET(self):
+        if self.latency:
+            time.sleep(self.latency)
+        super().do_GET()
+
+    def log_message(self, *args):
+        pass
+
+def serve(directory, latency_ms):
+    handler = type("Handler", (SlowHandler,), {"latency": latency_ms / 1000})
+    server = ThreadingHTTPServer(("127.0.0.1", 0), partial(handler, directory=directory))
+    threading.Thread(target=server.serve_forever, daemon=True).start()
+    return server
+
+def run(binary, seed, concurrency, output):
+    command = [binary, "-c", str(concurrency), "-d", "2", "--hook-timings", "-o", "json:" + output,
+               "modules.web.regex", "--", seed, "-t", PATTERN]
+    started = time.monotonic()
+    finished = subprocess.run(command, cwd=ROOT, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=True)
+    seconds = time.monotonic() - started
+    if finished.returncode != 0:
+        raise RuntimeError("%s failed:\n%s" % (" ".join(command), finished.stderr))
+
+    # The report goes to a file, so SUMMARY is printed on stdout and the HOOK lines on stderr
+    summary, hooks = None, {}
+    for line in (finished.stdout + finished.stderr).splitlines():
+        match = SUMMARY.match(line)
+        if match:
+            summary = match
+        match = HOOK.match(line)
+        if match:
+            hooks[match.group(1)] = {"calls": int(match.group(2)), "total": float(match.group(3)), "mean_ms": float(match.group(4))}
+    if summary is None:
+        raise RuntimeError("No SUMMARY line in the output of %s" % " ".join(command))
+    return seconds, summary, hooks
+
+def main():
+    parser = argparse.ArgumentParser(description="Benchmark valradar crawling a synthetic site")
+    parser.add_argument("--binary", default=os.path.join(ROOT, "target", "release", "valradar"), help="valradar binary to run")
+    parser.add_argument("--pages", type=int, default=200, help="Pages linked from the index")
+    parser.add_argument("--secret-every", type=int, default=10, help="Put a key on every Nth page, 0 for none")
+    parser.add_argument("--concurrency", type=int, nargs="+", default=[1, 4, 16], help="valradar -c values to run with")
+    parser.add_argument("--latency", type=float, default=0, help="Milliseconds the server waits before every response")
+    parser.add_argument("--fetcher", choices=["http", "file"], nargs="+", default=["http", "file"], help="Crawl over http, from disk or both")
+    args = parser.parse_args()
+
+    if not os.path.exists(args.binary):
+        parser.error("%s doesn't exist, build it with cargo build --release or pass --binary" % args.binary)
+
+    with tempfile.TemporaryDirectory() as directory:
+        site = os.path.join(directory, "site")
+        os.mkdir(site)
+        generate_site(site, args.pages, args.secret_every)
+        server = serve(site, args.latency) if "http" in args.fetcher else None
+        try:
+            for fetcher in args.fetcher:
+                if fetcher == "http":
+                    seed = "http://127.0.0.1:%d/index.html" % server.server_address[1]
+                else:
+                    seed = site
+                for concurrency in args.concurrency:
+                    seconds, summary, hooks = run(args.binary, seed, concurrency, os.path.join(directory, "results.json"))
+                    pages = int(summary.group(1))
+                    print(json.dumps({
+                        "pages": pages,
+                        "concurrency": concurrency,
+                        "fetcher": fetcher,
+                        "latency_ms": args.latency if fetcher == "http" else 0,
+                        "seconds": round(seconds, 3),
+                        "pages_per_second": round(pages / seconds, 1) if seconds else None,
+                        "results": int(summary.group(2)),
+                        "errors": int(summary.group(3)),
+                        "hooks": hooks,
+                    }))
+                    sys.stdout.flush()
+        finally:
+            if server:
+                server.shutdown()
+
+if __name__ == "__main__":
+    main()
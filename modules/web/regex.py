@@ -2,77 +2,3257 @@ import requests
 import bs4
 import re
 import argparse
+import base64
+import bisect
+import codecs
+import contextlib
+import fnmatch
+import gzip
+import hashlib
+import importlib.util
+import io
+import itertools
+import json
+import math
+import multiprocessing
+import os
+import shutil
+import socket
+import sqlite3
+import ssl
+import sys
+import tarfile
+import tempfile
+import threading
+import time
+import zipfile
+import zlib
+from collections import Counter, namedtuple
+from concurrent.futures import Future, ProcessPoolExecutor, ThreadPoolExecutor
+from datetime import datetime, timezone
+from email.utils import parsedate_to_datetime
+from urllib3.util import connection as urllib3_connection
+from urllib.robotparser import RobotFileParser
+from urllib.parse import parse_qsl, unquote, unquote_to_bytes, urljoin, urlsplit, urlunsplit
 
 headers = {
     "User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
 }
 
+# TLS 1.2 cipher orderings matching the ClientHello of common browsers. TLS 1.3
+# suites are negotiated by OpenSSL and can't be reordered from python.
+TLS_FINGERPRINTS = {
+    "chrome": "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:ECDHE-RSA-AES128-SHA:ECDHE-RSA-AES256-SHA:AES128-GCM-SHA256:AES256-GCM-SHA384:AES128-SHA:AES256-SHA",
+    "firefox": "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-AES256-SHA:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:ECDHE-RSA-AES256-SHA:AES128-GCM-SHA256:AES256-GCM-SHA384:AES128-SHA:AES256-SHA",
+}
+
+class ResolveAdapter(requests.adapters.HTTPAdapter):
+    # Dials the address resolve(host, port) gives instead of looking the hostname up, for the
+    # requests of the session it is mounted on only. Only the address dialed changes, urllib3
+    # still sends the url's hostname as SNI and Host and verifies the certificate against it,
+    # so vhosts on a shared IP work
+    def __init__(self, resolve=None, **kwargs):
+        self.resolve = resolve
+        super().__init__(**kwargs)
+
+    def init_poolmanager(self, *args, **kwargs):
+        super().init_poolmanager(*args, **kwargs)
+        self.resolve_pools(self.poolmanager)
+
+    def proxy_manager_for(self, proxy, **proxy_kwargs):
+        # The connections to an http proxy dial the proxy, --resolve can point its name elsewhere.
+        # SOCKS connections hand the hostname to the proxy, which resolves it itself
+        new = proxy not in self.proxy_manager
+        manager = super().proxy_manager_for(proxy, **proxy_kwargs)
+        if new and not proxy.lower().startswith("socks"):
+            self.resolve_pools(manager)
+        return manager
+
+    def resolve_pools(self, manager):
+        if self.resolve:
+            manager.pool_classes_by_scheme = {scheme: resolving_pool(pool, self.resolve) for scheme, pool in manager.pool_classes_by_scheme.items()}
+
+def resolving_pool(pool, resolve):
+    class Connection(pool.ConnectionCls):
+        def _new_conn(self):
+            # urllib3 dials _dns_host, host reads from it too so it's only swapped while dialing
+            dns_host = self._dns_host
+            self._dns_host = resolve(dns_host, self.port)
+            try:
+                return super()._new_conn()
+            finally:
+                self._dns_host = dns_host
+
+    return type(pool.__name__, (pool,), {"ConnectionCls": Connection})
+
+class CipherAdapter(ResolveAdapter):
+    def __init__(self, ciphers, **kwargs):
+        self.ciphers = ciphers
+        super().__init__(**kwargs)
+
+    def init_poolmanager(self, *args, **kwargs):
+        context = ssl.create_default_context()
+        context.set_ciphers(self.ciphers)
+        kwargs["ssl_context"] = context
+        return super().init_poolmanager(*args, **kwargs)
+
+def resolver(overrides, addresses=None):
+    # addresses holds the hostnames looked up ahead by --prefetch-dns, --resolve wins over them
+    addresses = {} if addresses is None else addresses
+
+    def resolve(host, port):
+        return overrides.get((host, port)) or addresses.get(host, host)
+
+    return resolve
+
+RESOURCE_TYPES = ["page", "file", "js-link", "script", "preload", "stylesheet", "asset", "sourcemap", "inline", "archive-entry", "probe", "off-scope"]
+# Version control metadata skipped when walking local directories
+SKIPPED_DIRECTORIES = {".git", ".hg", ".svn"}
+# js-link pages were guessed from url-like strings in scripts, they are crawled like any other page
+PAGE_TYPES = ("page", "js-link")
+# Pages served as anything else, JSON or plain text from APIs for instance, aren't parsed for links
+HTML_CONTENT_TYPES = ("text/html", "application/xhtml+xml")
+# Resources that link to more of their kind, chains of them are bounded by --script-depth
+ASSET_CHAIN_TYPES = ("script", "preload", "sourcemap", "stylesheet")
+# Paths that commonly leak secrets or source, probed on every host with --probe-common-paths
+COMMON_PATHS = [
+    "/.git/config", "/.git/HEAD", "/.svn/entries", "/.hg/hgrc",
+    "/.env", "/.env.local", "/.env.production", "/.env.backup",
+    "/.aws/credentials", "/.npmrc", "/.dockercfg", "/.docker/config.json", "/.htpasswd", "/.DS_Store",
+    "/docker-compose.yml", "/config.json", "/config.yml", "/web.config", "/phpinfo.php", "/server-status",
+    "/wp-config.php.bak", "/wp-config.php~", "/config.php.bak", "/settings.py.bak",
+    "/backup.zip", "/backup.tar.gz", "/backup.sql", "/db.sql", "/dump.sql", "/database.sql",
+    "/id_rsa", "/.ssh/id_rsa",
+]
+# Attributes that load a subresource, every other element only loads through src
+SUBRESOURCE_ATTRIBUTES = {"link": ("href",), "object": ("data",), "a": (), "area": (), "base": ()}
+# Media types of data: URIs that are not worth scanning as text
+BINARY_MEDIA_TYPES = ("image/", "audio/", "video/", "font/")
+# Content types skipped unless --scan-all-content-types is given
+DEFAULT_EXCLUDED_CONTENT_TYPES = [media_type + "*" for media_type in BINARY_MEDIA_TYPES]
+
+# Resource hints that point at resources the page is about to use
+PRELOAD_RELS = {"preload", "prefetch", "modulepreload"}
+
+CSS_URL_PATTERN = re.compile(r"url\(\s*['\"]?([^'\")]+?)['\"]?\s*\)")
+CSS_IMPORT_PATTERN = re.compile(r"@import\s+(?:url\(\s*)?['\"]([^'\"]+)['\"]")
+MARKUP = re.compile(r"<[^>]*>")
+INLINE_BLOCK = re.compile(
+    r"<script\b(?![^>]*\bsrc\s*=)[^>]*>(?P<script>.*?)</script\s*>"
+    r"|<style\b[^>]*>(?P<style>.*?)</style\s*>"
+    r"|<!--(?P<comment>.*?)-->",
+    re.IGNORECASE | re.DOTALL,
+)
+# Quoted strings in scripts that look like absolute urls or root relative paths
+JS_URL = re.compile(r"""["'`]((?:https?:)?//[^\s"'`<>]+|/[\w\-.~%]+(?:/[\w\-.~%]*)*(?:\?[^\s"'`<>]*)?)["'`]""")
+# Extensions of js-link candidates that are never pages
+JS_LINK_SKIPPED = (".js", ".mjs", ".css", ".map", ".png", ".jpg", ".jpeg", ".gif", ".svg", ".ico", ".webp", ".woff", ".woff2", ".ttf", ".json")
+SOURCE_MAPPING_URL = re.compile(r"[#@]\s*sourceMappingURL=(\S+)")
+# Anchor texts of "next page" links in listings without rel=next
+NEXT_PAGE_TEXT = re.compile(r"^(?:next(?: page)?|older (?:posts|entries))\s*[»›>→]*$|^[»›>→]$", re.IGNORECASE)
+
+CHUNK_SIZE = 64 * 1024
+MAX_REDIRECTS = 30
+# Characters shown around a match when it can't be tied to an HTML element
+TEXT_CONTEXT = 40
+# Ad networks, analytics, trackers, social widgets and font CDNs skipped with --exclude-common-thirdparty
+COMMON_THIRD_PARTY_DOMAINS = [
+    "google-analytics.com", "googletagmanager.com", "googlesyndication.com", "googleadservices.com", "doubleclick.net",
+    "fonts.googleapis.com", "fonts.gstatic.com", "facebook.com", "facebook.net", "twitter.com", "x.com", "linkedin.com",
+    "youtube.com", "hotjar.com", "segment.com", "segment.io", "mixpanel.com", "amplitude.com", "clarity.ms", "bat.bing.com",
+    "mc.yandex.ru", "nr-data.net", "cloudflareinsights.com", "adnxs.com", "criteo.com", "taboola.com", "outbrain.com",
+]
+
+def domain_matches(host, domain):
+    # Plain domains cover their subdomains too, anything with a wildcard is matched as a glob
+    if any(c in domain for c in "*?["):
+        return fnmatch.fnmatchcase(host, domain)
+    return host == domain or host.endswith("." + domain)
+
+# Paths of pages that redirects to are taken to be asking for a login
+LOGIN_PATH = re.compile(r"log-?in|sign-?in|/auth\b|/sso\b|/cas\b|oauth|session/new", re.IGNORECASE)
+# Context words used by the confidence heuristic
+SECRET_WORDS = re.compile(r"key|secret|token|passw(or)?d|pwd|auth|credential|api", re.IGNORECASE)
+PLACEHOLDER_WORDS = re.compile(r"example|dummy|sample|placeholder|xxxx|changeme", re.IGNORECASE)
+ASSIGNMENT = re.compile(r"[=:]\s*['\"]?$")
+
+Match = namedtuple("Match", ["value", "start", "end", "line", "column"])
+
+# UTF-32 goes first, its little endian mark starts with the UTF-16 one
+BOMS = [
+    (codecs.BOM_UTF8, "utf-8"),
+    (codecs.BOM_UTF32_LE, "utf-32-le"),
+    (codecs.BOM_UTF32_BE, "utf-32-be"),
+    (codecs.BOM_UTF16_LE, "utf-16-le"),
+    (codecs.BOM_UTF16_BE, "utf-16-be"),
+]
+
+def sniff_bom(data):
+    # A byte order mark wins over the charset from the headers
+    for bom, encoding in BOMS:
+        if data.startswith(bom):
+            return encoding, len(bom)
+    return None, 0
+
+def match_value(m):
+    # Mirror re.findall, which returns the group when the pattern has exactly one
+    return m.group(1) if m.re.groups == 1 else m.group(0)
+
+class ChunkScanner:
+    """Scans text that arrives in chunks. The last `max_match_len` characters of
+    every chunk are kept and rescanned with the next one so that matches spanning
+    a chunk boundary are still found."""
+
+    def __init__(self, types, max_match_len):
+        self.types = types
+        self.max_match_len = max_match_len
+        self.buffer = ""
+        self.offset = 0
+        # Line number at the start of the buffer and absolute offset where that line starts
+        self.line = 1
+        self.line_start = 0
+        self.consumed = {k: 0 for k in types.keys()}
+        self.results = {k: [] for k in types.keys()}
+
+    def feed(self, text, final = False):
+        self.buffer += text
+        cut = len(self.buffer) if final else max(len(self.buffer) - self.max_match_len, 0)
+
+        for k, pattern in self.types.items():
+            position, line, line_start = 0, self.line, self.line_start
+            for m in pattern.finditer(self.buffer):
+                start, end = self.offset + m.start(), self.offset + m.end()
+                # Matches starting in the tail are picked up again with the next chunk
+                if m.start() >= cut:
+                    break
+
+                newlines = self.buffer.count("\n", position, m.start())
+                if newlines:
+                    line += newlines
+                    line_start = self.offset + self.buffer.rfind("\n", position, m.start()) + 1
+                position = m.start()
+
+                # Skip what the previous round already reported, including suffixes of it
+                if start < self.consumed[k]:
+                    continue
+                self.results[k].append(Match(match_value(m), start, end, line, start - line_start + 1))
+                self.consumed[k] = max(end, start + 1)
+
+        newlines = self.buffer.count("\n", 0, cut)
+        if newlines:
+            self.line += newlines
+            self.line_start = self.offset + self.buffer.rfind("\n", 0, cut) + 1
+
+        self.buffer = self.buffer[cut:]
+        self.offset += cut
+
+    def finish(self):
+        self.feed("", final=True)
+        return self.results
+
+PATTERN_NAME = re.compile(r"^([A-Za-z_][\w-]*)=(.+)$", re.DOTALL)
+
+def parse_type(value, index):
+    # `name=regex` is labelled, anything else is the regex itself and gets an index
+    named = PATTERN_NAME.match(value)
+    if named:
+        return named.group(1), named.group(2)
+    return "pattern_%d" % index, value
+
+# Flags like (?i) have to stay in front of a pattern that is wrapped in a group
+GLOBAL_FLAGS = re.compile(r"^\(\?[aiLmsux]+\)")
+
+def wrap_pattern(pattern, whole_word, anchor):
+    flags = GLOBAL_FLAGS.match(pattern)
+    prefix = flags.group(0) if flags else ""
+    pattern = "(?:%s)" % pattern[len(prefix):]
+    if whole_word:
+        # Lookarounds rather than \b, so patterns starting or ending in punctuation still need a word edge
+        pattern = r"(?<!\w)%s(?!\w)" % pattern
+    if anchor in ("start", "line"):
+        pattern = "(?m:^)" + pattern
+    if anchor in ("end", "line"):
+        pattern = pattern + "(?m:$)"
+    return prefix + pattern
+
+def parse_range(value):
+    # prefix:N asks for the first N bytes, suffix:N for the last N bytes
+    kind, _, size = value.partition(":")
+    if kind not in ("prefix", "suffix") or not size.isdigit() or int(size) == 0:
+        raise argparse.ArgumentTypeError("expected prefix:BYTES or suffix:BYTES, got '%s'" % value)
+    size = int(size)
+    return "bytes=0-%d" % (size - 1) if kind == "prefix" else "bytes=-%d" % size
+
+SINCE_UNITS = {"s": 1, "m": 60, "h": 60 * 60, "d": 24 * 60 * 60, "w": 7 * 24 * 60 * 60}
+
+def parse_since(value):
+    # A duration back from now like the core's --interval (90m, 7d) or an ISO date, as a unix timestamp
+    duration = re.fullmatch(r"(\d+)([smhdw]?)", value.strip())
+    if duration:
+        return time.time() - int(duration.group(1)) * SINCE_UNITS[duration.group(2) or "s"]
+    try:
+        cutoff = datetime.fromisoformat(value.strip())
+    except ValueError:
+        raise argparse.ArgumentTypeError("expected a duration such as 7d or 12h, or an ISO date, got '%s'" % value)
+    if cutoff.tzinfo is None:
+        cutoff = cutoff.replace(tzinfo=timezone.utc)
+    return cutoff.timestamp()
+
+PROXY_SCHEMES = ("http", "https", "socks4", "socks4a", "socks5", "socks5h")
+
+def parse_proxy(value):
+    # socks5h:// resolves hostnames on the proxy, socks5:// locally. Credentials go in the url
+    parts = urlsplit(value)
+    if parts.scheme not in PROXY_SCHEMES or not parts.hostname or parts.port is None:
+        raise argparse.ArgumentTypeError("expected SCHEME://[USER:PASSWORD@]HOST:PORT with one of %s, got '%s'" % (", ".join(PROXY_SCHEMES), value))
+    return value
+
+def parse_resolve(value):
+    # Same form as curl's --resolve, the address may be a bracketed IPv6 one
+    host, _, rest = value.partition(":")
+    port, _, address = rest.partition(":")
+    if not host or not port.isdigit() or not address:
+        raise argparse.ArgumentTypeError("expected HOST:PORT:ADDRESS, got '%s'" % value)
+    return (host.lower(), int(port)), address.strip("[]")
+
+def load_session_state(session, path):
+    # Accepts a Playwright style storage state, e.g. from `playwright codegen --save-storage`
+    with open(path) as f:
+        set_session_cookies(session, json.load(f))
+
+def set_session_cookies(session, storage_state):
+    for cookie in storage_state.get("cookies", []):
+        session.cookies.set(cookie["name"], cookie["value"], domain=cookie.get("domain", ""), path=cookie.get("path", "/"))
+
+def browser_login(args):
+    # Only the login happens in a browser, the crawl itself stays on the HTTP fetcher
+    try:
+        from playwright.sync_api import sync_playwright, TimeoutError as PlaywrightTimeout
+    except ImportError:
+        raise ValueError("--login-then-crawl needs Playwright, install it with pip install playwright && playwright install chromium")
+
+    launch = {"headless": False}
+    if args.proxy:
+        # The login goes through the same proxy as the crawl
+        parts = urlsplit(args.proxy)
+        launch["proxy"] = {"server": "%s://%s:%d" % (parts.scheme.replace("socks5h", "socks5"), parts.hostname, parts.port)}
+        if parts.username:
+            launch["proxy"].update({"username": unquote(parts.username), "password": unquote(parts.password or "")})
+
+    with sync_playwright() as playwright:
+        browser = playwright.chromium.launch(**launch)
+        try:
+            context = browser.new_context(user_agent=headers["User-Agent"])
+            page = context.new_page()
+            page.goto(args.login_then_crawl)
+            try:
+                if args.login_success_url:
+                    page.wait_for_url(re.compile(args.login_success_url), timeout=args.login_timeout * 1000)
+                else:
+                    page.wait_for_selector(args.login_success_selector, timeout=args.login_timeout * 1000)
+            except PlaywrightTimeout:
+                raise ValueError("the login didn't succeed within %g seconds" % args.login_timeout)
+            # Written to --session-state too, so later runs can skip the login
+            return context.storage_state(path=args.session_state)
+        finally:
+            browser.close()
+
+def enclosing_element(tag, value):
+    # Walk up until the text or an attribute of the element actually holds the match
+    while tag is not None and tag.name != "[document]":
+        if value in tag.get_text():
+            return tag
+        for attribute in tag.attrs.values():
+            attribute = " ".join(attribute) if isinstance(attribute, list) else attribute
+            if value in attribute:
+                return tag
+        tag = tag.parent
+    return None
+
+def find_next_page(soup, url):
+    for tag in soup.find_all(["link", "a"]):
+        if "next" in (tag.get("rel") or []) and tag.get("href"):
+            return urljoin(url, tag.get("href"))
+
+    anchors = [a for a in soup.find_all("a") if a.get("href")]
+    for a in anchors:
+        if NEXT_PAGE_TEXT.match(a.get_text().strip()):
+            return urljoin(url, a.get("href"))
+
+    # Numbered pagination, the page after the one marked as current
+    current = soup.find(attrs={"aria-current": "page"})
+    if current is not None and current.get_text().strip().isdigit():
+        number = str(int(current.get_text().strip()) + 1)
+        for a in anchors:
+            if a.get_text().strip() == number:
+                return urljoin(url, a.get("href"))
+
+    return None
+
+def find_mixed_content(soup, url):
+    # Subresources loaded over plain http from an https page, navigation links don't count
+    references = []
+    for tag in soup.find_all(True):
+        for attribute in SUBRESOURCE_ATTRIBUTES.get(tag.name, ("src",)):
+            value = tag.get(attribute)
+            if isinstance(value, str) and urljoin(url, value.strip()).startswith("http://"):
+                reference = urljoin(url, value.strip())
+                if reference not in references:
+                    references.append(reference)
+    return references
+
+def entropy(value):
+    counts = Counter(value)
+    return -sum(n / len(value) * math.log2(n / len(value)) for n in counts.values())
+
+def confidence(m, content):
+    """Score from 0 to 100 of how likely a match is a real secret
+
+    Starts at 30, +40 when a word like key, secret or password precedes it within
+    TEXT_CONTEXT characters, +15 when it is assigned or quoted, +15 when it looks
+    random (over 3.5 bits of entropy per character) and -20 when placeholder words
+    like example or dummy surround it. Matches beyond the kept content (streaming
+    mode) only get the entropy part.
+    """
+    score = 30
+    before = content[max(0, m.start - TEXT_CONTEXT):m.start] if m.end <= len(content) else ""
+    around = content[max(0, m.start - TEXT_CONTEXT):m.end + TEXT_CONTEXT] if m.end <= len(content) else ""
+
+    if SECRET_WORDS.search(before):
+        score += 40
+    if ASSIGNMENT.search(before[-4:]) or (before[-1:] in ("'", '"') and before[-1:] == content[m.end:m.end + 1]):
+        score += 15
+    if len(m.value) >= 8 and entropy(m.value) > 3.5:
+        score += 15
+    if PLACEHOLDER_WORDS.search(around):
+        score -= 20
+
+    return max(0, min(100, score))
+
+def mask_secret(value, reveal):
+    # Keeps the first characters so the secret can still be told apart from others in a report
+    reveal = min(reveal, len(value) // 2)
+    return value[:reveal] + "*" * (len(value) - reveal)
+
+def describe_element(tag):
+    description = tag.name
+    if tag.get("id"):
+        description += "#" + tag.get("id")
+    for name in tag.get("class") or []:
+        description += "." + name
+    return description
+
+def peer_socket(response):
+    # The connection is still checked out while the body hasn't been streamed, once the
+    # server announced it will close the socket moves to the body file object instead
+    connection = getattr(response.raw, "connection", None)
+    sock = getattr(connection, "sock", None)
+    if sock is None:
+        fp = getattr(getattr(response.raw, "_fp", None), "fp", None)
+        sock = getattr(getattr(fp, "raw", None), "_sock", None)
+    return sock if hasattr(sock, "getpeercert") else None
+
+def is_data_uri(value):
+    return isinstance(value, str) and value.strip().lower().startswith("data:")
+
+def parse_data_uri(uri):
+    # data:[<media type>][;charset=...][;base64],<payload>
+    header, separator, payload = uri[len("data:"):].partition(",")
+    if not separator:
+        raise ValueError("data: URI without a payload")
+
+    params = header.split(";")
+    media_type = params[0].strip().lower() or "text/plain"
+    charset = "us-ascii" if params[0] == "" else "utf-8"
+    for param in params[1:]:
+        if param.lower().startswith("charset="):
+            charset = param[len("charset="):]
+
+    data = unquote_to_bytes(payload)
+    if "base64" in (param.strip().lower() for param in params[1:]):
+        data = base64.b64decode(data + b"=" * (-len(data) % 4))
+    return media_type, charset, data
+
+def codec_exists(name):
+    try:
+        codecs.lookup(name)
+        return True
+    except LookupError:
+        return False
+
+# Documents --scan-documents extracts text from, by content type and by extension
+DOCUMENT_CONTENT_TYPES = {
+    "application/pdf": "pdf",
+    "application/vnd.openxmlformats-officedocument.wordprocessingml.document": "docx",
+    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": "xlsx",
+    "application/vnd.openxmlformats-officedocument.presentationml.presentation": "pptx",
+    "application/vnd.oasis.opendocument.text": "odt",
+    "application/vnd.oasis.opendocument.spreadsheet": "ods",
+    "application/vnd.oasis.opendocument.presentation": "odp",
+}
+DOCUMENT_EXTENSIONS = {kind: kind for kind in DOCUMENT_CONTENT_TYPES.values()}
+# Members of the zip based formats holding their text
+DOCUMENT_MEMBERS = {
+    "docx": re.compile(r"word/(document|header\d*|footer\d*|footnotes|comments)\.xml$|docProps/core\.xml$"),
+    "xlsx": re.compile(r"xl/sharedStrings\.xml$|xl/worksheets/[^/]+\.xml$|docProps/core\.xml$"),
+    "pptx": re.compile(r"ppt/(slides|notesSlides)/[^/]+\.xml$|docProps/core\.xml$"),
+    "odt": re.compile(r"(content|meta)\.xml$"),
+}
+DOCUMENT_MEMBERS["ods"] = DOCUMENT_MEMBERS["odp"] = DOCUMENT_MEMBERS["odt"]
+PDF_STREAM = re.compile(rb"stream\r?\n(.*?)\r?\nendstream", re.DOTALL)
+PDF_TEXT = re.compile(rb"\(((?:\\.|[^\\)])*)\)")
+
+def document_kind(response):
+    content_type = response.headers.get("Content-Type", "").split(";")[0].strip().lower()
+    if content_type in DOCUMENT_CONTENT_TYPES:
+        return DOCUMENT_CONTENT_TYPES[content_type]
+    extension = urlsplit(response.url).path.rsplit(".", 1)[-1].lower()
+    if content_type in ("", "application/octet-stream") and extension in DOCUMENT_EXTENSIONS:
+        return extension
+    return None
+
+ARCHIVE_CONTENT_TYPES = {
+    "application/zip": "zip",
+    "application/x-zip-compressed": "zip",
+    "application/java-archive": "zip",
+    "application/x-tar": "tar",
+    "application/x-gtar": "tar",
+    "application/gzip": "gz",
+    "application/x-gzip": "gz",
+}
+ARCHIVE_EXTENSIONS = {".zip": "zip", ".jar": "zip", ".war": "zip", ".ear": "zip", ".tar": "tar", ".tgz": "tar", ".tar.gz": "tar", ".tar.bz2": "tar", ".tar.xz": "tar", ".gz": "gz"}
+
+def archive_kind(response):
+    content_type = response.headers.get("Content-Type", "").split(";")[0].strip().lower()
+    if content_type in ARCHIVE_CONTENT_TYPES:
+        return ARCHIVE_CONTENT_TYPES[content_type]
+    path = urlsplit(response.url).path.lower()
+    if content_type in ("", "application/octet-stream"):
+        # The longest extension first, .tar.gz is a tarball and not a single gzipped file
+        for extension in sorted(ARCHIVE_EXTENSIONS, key=len, reverse=True):
+            if path.endswith(extension):
+                return ARCHIVE_EXTENSIONS[extension]
+    return None
+
+def archive_members(kind, data, name):
+    """Yield (path, file object) for every regular file in an archive"""
+    if kind == "zip":
+        with zipfile.ZipFile(io.BytesIO(data)) as archive:
+            for info in archive.infolist():
+                if not info.is_dir():
+                    with archive.open(info) as f:
+                        yield info.filename, f
+        return
+
+    try:
+        with tarfile.open(fileobj=io.BytesIO(data), mode="r:*") as archive:
+            for info in archive:
+                if info.isfile():
+                    yield info.name, archive.extractfile(info)
+        return
+    except tarfile.ReadError:
+        if kind != "gz":
+            raise
+
+    # A single gzipped file, named after the archive
+    with gzip.GzipFile(fileobj=io.BytesIO(data)) as f:
+        yield name[:-len(".gz")] if name.endswith(".gz") else name, f
+
+def extract_archive_entries(kind, data, name, max_entries, max_size, stats):
+    """The text entries of an archive, at most max_entries of them and max_size bytes extracted in all"""
+    entries = []
+    budget = max_size
+    for path, f in archive_members(kind, data, name):
+        if len(entries) >= max_entries or budget <= 0:
+            # Entry counts and sizes are bounded so a zip bomb can't exhaust memory
+            stats["archive_limited"] += 1
+            break
+        content = f.read(budget + 1)
+        if len(content) > budget:
+            stats["archive_limited"] += 1
+            break
+        budget -= len(content)
+        # Like grep, entries with NUL bytes early on are taken to be binary
+        if b"\0" in content[:8192]:
+            stats["archive_binary"] += 1
+            continue
+        entries.append((path, content.decode("utf-8", errors="replace")))
+    return entries
+
+def extract_document_text(kind, data):
+    if kind == "pdf":
+        return extract_pdf_text(data)
+
+    parts = []
+    with zipfile.ZipFile(io.BytesIO(data)) as archive:
+        for name in archive.namelist():
+            if DOCUMENT_MEMBERS[kind].search(name):
+                parts.append(MARKUP.sub(" ", archive.read(name).decode("utf-8", errors="replace")))
+    return "\n".join(parts)
+
+def extract_pdf_text(data):
+    # pypdf understands every encoding and font, without it the text operators of
+    # plain and deflated content streams are read directly
+    try:
+        import pypdf
+        reader = pypdf.PdfReader(io.BytesIO(data))
+        return "\n".join(page.extract_text() or "" for page in reader.pages)
+    except ImportError:
+        pass
+
+    parts = []
+    for stream in PDF_STREAM.findall(data):
+        try:
+            stream = zlib.decompressobj().decompress(stream)
+        except zlib.error:
+            pass
+        parts.extend(text.decode("latin-1") for text in PDF_TEXT.findall(stream))
+    return "\n".join(parts)
+
+def debug(message):
+    if "VALRADAR_DEBUG" in os.environ:
+        print(message)
+
+def load_patterns_file(path):
+    """The patterns of a --patterns-file as (name=regex, context) pairs, context is None when not given
+
+    The file is a JSON object of pattern names to either a regex or {"pattern": regex, "context": N}
+    """
+    with open(path) as f:
+        patterns = json.load(f)
+    if not isinstance(patterns, dict):
+        raise ValueError("%s: expected an object of pattern names to patterns" % path)
+
+    loaded = []
+    for name, value in patterns.items():
+        if not PATTERN_NAME.match("%s=." % name):
+            raise ValueError("%s: '%s' isn't a valid pattern name" % (path, name))
+        pattern, context = (value.get("pattern"), value.get("context")) if isinstance(value, dict) else (value, None)
+        if not isinstance(pattern, str) or not pattern:
+            raise ValueError("%s: '%s' needs a pattern" % (path, name))
+        if context is not None and (type(context) is not int or context < 0):
+            raise ValueError("%s: context of '%s' must be a number of characters, got %r" % (path, name, context))
+        loaded.append(("%s=%s" % (name, pattern), context))
+    return loaded
+
+def load_lines(path):
+    with open(path) as f:
+        return [line.strip() for line in f if line.strip() and not line.startswith("#")]
+
+WHITESPACE_RUN = re.compile(r"\s+")
+
+def normalize_whitespace(text, mode):
+    """text with every whitespace run collapsed to one space, or removed with mode "remove"
+
+    Also returns the (normalized, original) offsets every piece of the result
+    starts at, a piece being copied as is up to the next one.
+    """
+    replacement = "" if mode == "remove" else " "
+    parts, segments = [], [(0, 0)]
+    position = length = 0
+    for m in WHITESPACE_RUN.finditer(text):
+        if m.group(0) == replacement:
+            continue
+        parts.append(text[position:m.start()] + replacement)
+        length += m.start() - position + len(replacement)
+        position = m.end()
+        segments.append((length, position))
+    parts.append(text[position:])
+    return "".join(parts), segments
+
+def original_offset(segments, starts, offset):
+    normalized, position = segments[bisect.bisect_right(starts, offset) - 1]
+    return position + offset - normalized
+
+def original_match(m, segments, starts, line_starts):
+    # The value stays the one the pattern matched, its position is moved back onto the original text
+    start = original_offset(segments, starts, m.start)
+    end = original_offset(segments, starts, m.end - 1) + 1 if m.end > m.start else start
+    line = bisect.bisect_right(line_starts, start)
+    return Match(m.value, start, end, line, start - line_starts[line - 1] + 1)
+
+def scan_text(text, types, whitespace = None):
+    if whitespace:
+        # --normalize-whitespace, patterns see the text with its whitespace collapsed or removed
+        normalized, segments = normalize_whitespace(text, whitespace)
+        starts = [start for start, _ in segments]
+        line_starts = [0] + [m.end() for m in re.finditer("\n", text)]
+        return {k: [original_match(m, segments, starts, line_starts) for m in matches] for k, matches in scan_text(normalized, types).items()}
+
+    scanner = ChunkScanner(types, 0)
+    scanner.feed(text)
+    return scanner.finish()
+
+# Run by every --scan-workers process before its first scan, with the name and path of this module
+SCAN_WORKER_SETUP = """
+import importlib.util, sys
+spec = importlib.util.spec_from_file_location(name, path)
+module = importlib.util.module_from_spec(spec)
+sys.modules[name] = module
+spec.loader.exec_module(module)
+"""
+
+# Bodies queued per --scan-workers process before fetching waits for the scans to catch up
+SCAN_QUEUE_PER_WORKER = 2
+
+def suspend_progress(callback):
+    # The valradar module is there when the plugin runs inside valradar
+    valradar = sys.modules.get("valradar")
+    if valradar is None or not hasattr(valradar, "suspend_progress"):
+        return callback()
+    return valradar.suspend_progress(callback)
+
+def own_matches(result):
+    # A copy of a cached scan result that a context can filter and extend without touching the cache
+    return {k: list(matches) for k, matches in result.items()}
+
+def recorded_matches(context):
+    return {k: [list(m) for m in v] for k, v in context.types_result.items()}
+
+class MemoryFrontier:
+    """Pending and visited urls kept in memory
+
+    Every operation is a dict or set lookup, but the frontier grows with the crawl
+    and has to fit in memory next to everything else.
+    """
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.pending = {}
+        self.visited = {}
+
+    def push(self, url, resource_type, depth):
+        with self.lock:
+            if url not in self.visited:
+                self.pending.setdefault(url, (resource_type, depth))
+
+    def pop(self, url):
+        """Take url off the frontier to crawl it, False when it was already visited"""
+        with self.lock:
+            self.pending.pop(url, None)
+            if url in self.visited:
+                return False
+            # A dict keeps the visiting order, which the state file and summaries rely on
+            self.visited[url] = None
+            return True
+
+    def seen(self, url):
+        with self.lock:
+            return url in self.visited
+
+    def visited_urls(self):
+        with self.lock:
+            return list(self.visited)
+
+    def pending_urls(self):
+        with self.lock:
+            return [(url, resource_type, depth) for url, (resource_type, depth) in self.pending.items()]
+
+    def visited_count(self):
+        with self.lock:
+            return len(self.visited)
+
+    def close(self):
+        pass
+
+class DiskFrontier:
+    """Pending and visited urls kept in a SQLite database
+
+    Memory use stays flat however large the site is, at the cost of an indexed
+    lookup on disk (usually served from the page cache) for every operation.
+    A temporary database is used and removed at the end unless a path is given.
+    A given one starts out empty unless resume is set.
+    """
+
+    def __init__(self, path=None, resume=False):
+        self.temporary = path is None
+        if path is None:
+            handle, path = tempfile.mkstemp(prefix="valradar-frontier-", suffix=".db")
+            os.close(handle)
+        self.path = path
+        self.lock = threading.Lock()
+        # Every worker thread shares the connection, the lock serializes them
+        self.db = sqlite3.connect(path, check_same_thread=False, isolation_level=None)
+        self.db.execute("PRAGMA journal_mode=WAL")
+        self.db.execute("PRAGMA synchronous=OFF")
+        self.db.execute("CREATE TABLE IF NOT EXISTS pending (url TEXT PRIMARY KEY, type TEXT, depth INTEGER)")
+        self.db.execute("CREATE TABLE IF NOT EXISTS visited (id INTEGER PRIMARY KEY, url TEXT UNIQUE)")
+        if not resume:
+            # Left from an earlier crawl, which would otherwise keep this one from visiting anything
+            self.db.execute("DELETE FROM pending")
+            self.db.execute("DELETE FROM visited")
+
+    def push(self, url, resource_type, depth):
+        with self.lock:
+            self.db.execute(
+                "INSERT OR IGNORE INTO pending SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM visited WHERE url = ?)",
+                (url, resource_type, depth, url),
+            )
+
+    def pop(self, url):
+        """Take url off the frontier to crawl it, False when it was already visited"""
+        with self.lock:
+            self.db.execute("DELETE FROM pending WHERE url = ?", (url,))
+            return self.db.execute("INSERT OR IGNORE INTO visited (url) VALUES (?)", (url,)).rowcount == 1
+
+    def seen(self, url):
+        with self.lock:
+            return self.db.execute("SELECT 1 FROM visited WHERE url = ?", (url,)).fetchone() is not None
+
+    def visited_urls(self):
+        with self.lock:
+            return [url for (url,) in self.db.execute("SELECT url FROM visited ORDER BY id")]
+
+    def pending_urls(self):
+        with self.lock:
+            return self.db.execute("SELECT url, type, depth FROM pending").fetchall()
+
+    def visited_count(self):
+        with self.lock:
+            return self.db.execute("SELECT COUNT(*) FROM visited").fetchone()[0]
+
+    def close(self):
+        with self.lock:
+            self.db.close()
+        if self.temporary:
+            for suffix in ("", "-wal", "-shm"):
+                if os.path.exists(self.path + suffix):
+                    os.remove(self.path + suffix)
+
+class SpillFile:
+    """Contents of finished resources moved out of memory by --max-memory"""
+
+    def __init__(self):
+        self.file = tempfile.TemporaryFile(prefix="valradar-spill-")
+        self.lock = threading.Lock()
+
+    def write(self, text):
+        data = text.encode("utf-8", errors="replace")
+        with self.lock:
+            offset = self.file.seek(0, os.SEEK_END)
+            self.file.write(data)
+        return offset, len(data)
+
+    def read(self, offset, length):
+        with self.lock:
+            self.file.seek(offset)
+            return self.file.read(length).decode("utf-8", errors="replace")
+
+def read_state(path):
+    with open(path, "rb") as f:
+        content = f.read()
+    # Both compressed and plain state files are read, told apart by the gzip magic bytes
+    if content[:2] == b"\x1f\x8b":
+        content = gzip.decompress(content)
+    return json.loads(content)
+
+def stored_records(path):
+    """The records of a state file written with --store-content, for --replay"""
+    records = {url: record for url, record in read_state(path)["records"].items() if record.get("content") is not None}
+    if not records:
+        raise ValueError("state file '%s' holds no content, only crawls run with --store-content can be replayed" % path)
+    return records
+
+def resident_memory():
+    # The current resident set where /proc has it, the peak one on other Unixes and None
+    # where neither exists, like on Windows
+    try:
+        with open("/proc/self/statm") as f:
+            return int(f.read().split()[1]) * os.sysconf("SC_PAGE_SIZE")
+    except (OSError, ValueError, IndexError):
+        pass
+    try:
+        import resource
+    except ImportError:
+        return None
+    # macOS reports bytes, the others KB
+    peak = resource.getrusage(resource.RUSAGE_SELF).ru_maxrss
+    return peak if sys.platform == "darwin" else peak * 1024
+
+class CrawlState:
+    """State shared by every context of a crawl"""
+
+    def __init__(self):
+        self.started = time.time()
+        self.seeds = []
+        self.lock = threading.Lock()
+        # Urls waiting to be crawled and the ones already visited, see --frontier
+        self.frontier = MemoryFrontier()
+        # Every crawl has its own session, configured by init with the proxy, TLS and cookie options,
+        # so watch cycles and library scans reusing the loaded module don't share cookies
+        self.session = requests.Session()
+        self.session.headers.update(headers)
+        # Scans by content hash and patterns, futures of the ones --scan-workers are still running.
+        # The results are shared, every context copies them before filtering its matches
+        self.scan_cache = {}
+        # --normalize-whitespace, "collapse" or "remove"
+        self.whitespace = None
+        # Processes buffered bodies are scanned in with --scan-workers, None scans in the calling worker.
+        # Fetching waits for a slot when as many bodies as scan_slots allows are queued
+        self.scan_pool = None
+        self.scan_slots = None
+        self.scan_lock = threading.Lock()
+        # Contexts recorded before their scan finished, by key, their matches are filled in by scanned_records
+        self.unscanned = {}
+        # --fetch-workers, how many requests are in flight at once across valradar's workers
+        self.fetch_slots = contextlib.nullcontext()
+        # --interactive-on-match asks one question at a time, other workers finding matches wait for it
+        self.prompt_lock = threading.Lock()
+        self.interactive = False
+        self.stopped = False
+        # --exclude-domains and --exclude-common-thirdparty
+        self.excluded_domains = []
+        # --scope and --scope-file, other hosts links guessed from scripts may lead to
+        self.scope_domains = []
+        # Values crawled of every query parameter, by host, path and parameter name
+        self.param_values = {}
+        # Urls redirecting to every redirect target, by target without its query
+        self.redirect_sources = {}
+        # Redirect targets taken to be login pages
+        self.login_targets = set()
+        # Hostnames resolved ahead of the requests to them with --prefetch-dns
+        self.dns_pool = None
+        self.dns_cache = {}
+        self.dns_requested = set()
+        self.stats = Counter()
+        # Resources per crawl depth, anything discovered but not fetched was skipped
+        self.discovered = Counter()
+        self.fetched = Counter()
+        # --extract-inline blocks by their inline: url, and the first url of every distinct block content
+        self.inline_blocks = {}
+        self.inline_urls = {}
+        # Where every distinct match was found first and in which resource types, built for --dedupe-matches
+        self.match_index = None
+        # Hosts of the seed urls, redirects leaving them are off-scope
+        self.scope_hosts = set()
+        # robots.txt of every host (None when it couldn't be read) and when each host may be requested next
+        self.robots = {}
+        self.host_next_request = {}
+        # Hosts whose --probe-common-paths requests were already queued
+        self.probed_hosts = set()
+        self.probe_paths = []
+        # References to hosts outside the scope and the ones actually requested
+        self.external_links = Counter()
+        self.external_contacted = set()
+        # User agents to rotate through, the session default is used when empty
+        self.user_agents = []
+        self.rotate_per_host = False
+        self.requests = 0
+        self.host_agents = {}
+        # Peer certificate of every https host, captured from its first response
+        self.certificates = {}
+        # Requests are spaced out one at a time until this time after a match was found
+        self.cooldown_until = 0
+        self.throttle_lock = threading.Lock()
+        # --max-memory soft limit in bytes, the contexts still holding their content and where it goes
+        self.max_memory = 0
+        self.store_content = False
+        self.resident = []
+        self.spill_file = None
+        # Crawl progress periodically flushed to --state-file so a killed crawl can resume
+        self.state_file = None
+        self.compress_state = True
+        self.flush_interval = 0
+        self.flush_every = 0
+        self.records = {}
+        self.unflushed = 0
+        self.last_flush = time.time()
+        self.flush_lock = threading.Lock()
+
+    def in_scope(self, url):
+        return urlsplit(url).hostname in self.scope_hosts
+
+    def in_declared_scope(self, url):
+        """Whether url is on a seed host or a --scope domain"""
+        host = (urlsplit(url).hostname or "").lower()
+        return host in self.scope_hosts or any(domain_matches(host, domain) for domain in self.scope_domains)
+
+    def exploding_param(self, url, limit):
+        """The query parameter of url that already had limit other values crawled on the same path, None when it may be crawled"""
+        parts = urlsplit(url)
+        params = [((parts.netloc, parts.path, name), value) for name, value in parse_qsl(parts.query, keep_blank_values=True)]
+        with self.lock:
+            for key, value in params:
+                values = self.param_values.setdefault(key, set())
+                if value not in values and len(values) >= limit:
+                    return key[2]
+            # Values only count once the url is actually crawled
+            for key, value in params:
+                self.param_values[key].add(value)
+        return None
+
+    def excluded_domain(self, url):
+        host = (urlsplit(url).hostname or "").lower()
+        return any(domain_matches(host, domain) for domain in self.excluded_domains)
+
+    def user_agent(self, url):
+        if not self.user_agents:
+            return None
+
+        with self.lock:
+            if self.rotate_per_host:
+                host = urlsplit(url).hostname
+                if host not in self.host_agents:
+                    self.host_agents[host] = self.user_agents[len(self.host_agents) % len(self.user_agents)]
+                return self.host_agents[host]
+
+            self.requests += 1
+            return self.user_agents[(self.requests - 1) % len(self.user_agents)]
+
+    def record(self, context):
+        # A scan still running in --scan-workers isn't waited for, its matches are filled in when the records are read
+        scanning = context.pending_scan is not None
+        matches = None if scanning else recorded_matches(context)
+        with self.lock:
+            if scanning:
+                self.unscanned[context.key] = context
+            else:
+                self.unscanned.pop(context.key, None)
+            self.records[context.key] = {
+                "type": context.resource_type,
+                "depth": context.depth,
+                "status": context.data.get('status'),
+                "matches": matches,
+                "etag": context.data.get('etag'),
+                "last_modified": context.data.get('last_modified'),
+                "sha256": context.data.get('sha256'),
+            }
+            if self.store_content:
+                self.records[context.key]["content"] = context.data.get('content')
+            self.unflushed += 1
+
+    def scanned_records(self):
+        """The records, once the scans they were recorded during are finished"""
+        with self.lock:
+            unscanned, self.unscanned = self.unscanned, {}
+        for key, context in unscanned.items():
+            matches = recorded_matches(context)
+            with self.lock:
+                self.records[key]["matches"] = matches
+        return self.records
+
+    def retain(self, context):
+        if self.max_memory > 0 and context.data.get('content'):
+            with self.lock:
+                self.resident.append(context)
+
+    def check_memory(self):
+        if self.max_memory <= 0:
+            return
+
+        # Spilling starts a little before the limit, the crawl keeps allocating while it runs
+        used = resident_memory()
+        if used < self.max_memory * 0.9:
+            return
+
+        with self.lock:
+            contexts, self.resident = self.resident, []
+            if self.spill_file is None:
+                self.spill_file = SpillFile()
+        for context in contexts:
+            if 'content' in context.data:
+                context.data['spilled'] = self.spill_file.write(context.data.pop('content'))
+        with self.lock:
+            self.stats["spilled"] += len(contexts)
+        debug("Spilled the content of %d resources at %d MB resident, now %d MB" % (len(contexts), used >> 20, resident_memory() >> 20))
+
+    def maybe_flush(self):
+        if self.state_file is None:
+            return
+
+        with self.lock:
+            due = (self.flush_every > 0 and self.unflushed >= self.flush_every) or \
+                (self.flush_interval > 0 and time.time() - self.last_flush >= self.flush_interval)
+        if due:
+            self.flush()
+
+    def flush(self):
+        # Only one worker writes at a time, the others carry on crawling instead of waiting
+        if self.state_file is None or not self.flush_lock.acquire(blocking=False):
+            return
+
+        try:
+            self.scanned_records()
+            with self.lock:
+                snapshot = {
+                    "processed": self.frontier.visited_urls(),
+                    "pending": [list(item) for item in self.frontier.pending_urls()],
+                    "records": dict(self.records),
+                }
+                self.unflushed = 0
+                self.last_flush = time.time()
+
+            content = json.dumps(snapshot).encode()
+            if self.compress_state:
+                content = gzip.compress(content)
+
+            # Written next to the state file and renamed over it so a crash never leaves it half written
+            temporary = self.state_file + ".tmp"
+            with open(temporary, "wb") as f:
+                f.write(content)
+                f.flush()
+                os.fsync(f.fileno())
+            os.replace(temporary, self.state_file)
+        finally:
+            self.flush_lock.release()
+
+    def load(self):
+        return read_state(self.state_file)
+
+    def robots_for(self, url, timeout):
+        parts = urlsplit(url)
+        with self.lock:
+            if parts.netloc in self.robots:
+                return self.robots[parts.netloc]
+
+        # Fetched outside the lock, two workers racing for the same host both fetching it is harmless
+        robots = None
+        try:
+            response = self.session.get("%s://%s/robots.txt" % (parts.scheme, parts.netloc), timeout=timeout)
+            if response.status_code == 200:
+                robots = RobotFileParser()
+                robots.parse(response.text.splitlines())
+        except requests.RequestException as e:
+            debug("Failed to fetch robots.txt for %s: %s" % (parts.netloc, e))
+
+        with self.lock:
+            return self.robots.setdefault(parts.netloc, robots)
+
+    def wait_for_host(self, url, delay):
+        # Each request books the next slot of its host, then sleeps until its own slot comes
+        host = urlsplit(url).netloc
+        with self.lock:
+            if host not in self.host_next_request:
+                debug("Crawl delay for %s: %ss" % (host, delay))
+            now = time.time()
+            slot = max(now, self.host_next_request.get(host, 0))
+            self.host_next_request[host] = slot + delay
+        if slot > now:
+            time.sleep(slot - now)
+
+    def start_cooldown(self, duration):
+        with self.lock:
+            self.cooldown_until = time.time() + duration
+
+    def throttle(self, delay):
+        if time.time() >= self.cooldown_until:
+            return
+
+        # Holding the lock while sleeping lets a single request through per delay across all workers
+        with self.throttle_lock:
+            time.sleep(delay)
+        with self.lock:
+            self.stats["throttled"] += 1
+
+    def add_inline_block(self, page_url, name, content, dedupe):
+        """Register a block found inline on a page, returns its url or None when an identical one was already seen"""
+        content_hash = hashlib.sha256(content.encode()).hexdigest()
+        with self.lock:
+            url = self.inline_urls.get(content_hash)
+            if dedupe and url is not None:
+                self.inline_blocks[url]["pages"].append(page_url)
+                self.stats["inline_duplicates"] += 1
+                return None
+
+            url = "inline:%s#%s" % (page_url, name)
+            self.inline_blocks[url] = {"content": content, "pages": [page_url]}
+            self.inline_urls.setdefault(content_hash, url)
+            self.stats["inline_blocks"] += 1
+            return url
+
+    def add_archive_entry(self, archive_url, path, content):
+        """Register an entry read from an archive, returns the url it is listed under"""
+        url = "%s!/%s" % (archive_url, path.lstrip("/"))
+        with self.lock:
+            self.inline_blocks[url] = {"content": content, "pages": [archive_url]}
+            self.stats["archive_entries"] += 1
+        return url
+
+    def first_sightings(self, across_types):
+        """Index of (pattern, value) or (pattern, value, type) to the first url with it and the types it was found in"""
+        self.scanned_records()
+        with self.lock:
+            if self.match_index is None:
+                # Built once every resource is collected, records are kept in crawl order
+                self.match_index = {}
+                for url, record in self.records.items():
+                    for k, matches in record["matches"].items():
+                        for m in matches:
+                            key = (k, m[0]) if across_types else (k, m[0], record["type"])
+                            sighting = self.match_index.setdefault(key, {"url": url, "types": set(), "resources": set()})
+                            sighting["types"].add(record["type"])
+                            sighting["resources"].add(url)
+            return self.match_index
+
+    def ask_on_match(self, context):
+        """What to do after context found matches: continue, skip or stop"""
+        with self.prompt_lock:
+            if self.stopped:
+                return "stop"
+            if not self.interactive:
+                return "continue"
+
+            # valradar's progress bar would be drawn over the question
+            return suspend_progress(lambda: self.prompt_on_match(context))
+
+    def prompt_on_match(self, context):
+        """Show the matches of context and read what to do, see ask_on_match"""
+        sys.stderr.write("\n%s matched:\n" % context.url)
+        for k, matches in context.types_result.items():
+            if matches:
+                values = [m.value for m in matches[:5]]
+                more = " and %d more" % (len(matches) - 5) if len(matches) > 5 else ""
+                sys.stderr.write("  %s: %s%s\n" % (k, ", ".join(values), more))
+
+        while True:
+            sys.stderr.write("[c]ontinue, [s]kip the links found here, [a]sk no more, [q]uit crawling: ")
+            sys.stderr.flush()
+            answer = sys.stdin.readline()
+            if not answer:
+                # stdin was closed, the crawl carries on without asking
+                self.interactive = False
+                return "continue"
+            answer = answer.strip().lower()[:1]
+            if answer == "c":
+                return "continue"
+            if answer == "a":
+                self.interactive = False
+                return "continue"
+            if answer == "s":
+                self.stats["skipped_interactively"] += 1
+                return "skip"
+            if answer == "q":
+                self.stopped = True
+                return "stop"
+
+    def redirected_to_login(self, url, target, threshold):
+        """Whether url redirecting to target is one more of the urls behind a login
+
+        The first url redirected to a login page still gets it scanned, the others are
+        only counted. Targets count as login pages by their path, or once threshold urls
+        are redirected to them.
+        """
+        target = urlunsplit(urlsplit(target)._replace(query="", fragment=""))
+        with self.lock:
+            sources = self.redirect_sources.setdefault(target, [])
+            if url not in sources:
+                sources.append(url)
+            if LOGIN_PATH.search(urlsplit(target).path) or len(sources) >= threshold:
+                self.login_targets.add(target)
+            return target in self.login_targets and sources[0] != url
+
+    def prefetch_dns(self, urls):
+        hosts = {urlsplit(url).hostname for url in urls if url.startswith("http")}
+        with self.lock:
+            hosts -= self.dns_requested
+            self.dns_requested.update(hosts)
+        for host in hosts:
+            if host:
+                self.dns_pool.submit(self.resolve, host)
+
+    def resolve(self, host):
+        try:
+            addresses = socket.getaddrinfo(host, None, urllib3_connection.allowed_gai_family(), socket.SOCK_STREAM)
+        except (OSError, UnicodeError):
+            # The request itself looks the host up again and reports the failure
+            return
+        if addresses:
+            with self.lock:
+                self.dns_cache[host] = addresses[0][4][0]
+                self.stats["dns_prefetched"] += 1
+
+    def start_scan_workers(self, workers):
+        # Spawned rather than forked, valradar already runs threads by now and Windows can't fork.
+        # Every worker loads this file under the name of the module, which pickled patterns
+        # and matches refer to
+        context = multiprocessing.get_context("spawn")
+        if not os.path.basename(sys.executable).lower().startswith("python"):
+            # Embedded in valradar, sys.executable is valradar itself
+            executable = shutil.which("python3") or shutil.which("python")
+            if executable is None:
+                raise ValueError("--scan-workers needs python or python3 on the PATH to start its processes")
+            context.set_executable(executable)
+        self.scan_pool = ProcessPoolExecutor(workers, mp_context=context, initializer=exec, initargs=(SCAN_WORKER_SETUP, {"name": __name__, "path": __file__}))
+        self.scan_slots = threading.BoundedSemaphore(workers * SCAN_QUEUE_PER_WORKER)
+
+    def submit_scan(self, content_hash, text, types):
+        """A future of the matches of text, scanned by --scan-workers when they run"""
+        # Identical bodies served under different urls are only scanned once per set of patterns
+        key = (content_hash, tuple((k, pattern.pattern, pattern.flags) for k, pattern in sorted(types.items())))
+        with self.lock:
+            cached = self.scan_cache.get(key)
+            if cached is not None:
+                self.stats["scans_saved"] += 1
+                return cached
+
+        if self.scan_pool is not None:
+            self.scan_slots.acquire()
+            future = self.scan_pool.submit(scan_text, text, types, self.whitespace)
+            future.add_done_callback(lambda _: self.scan_slots.release())
+        else:
+            future = Future()
+            future.set_result(scan_text(text, types, self.whitespace))
+        with self.lock:
+            self.scan_cache[key] = future
+            self.stats["scans"] += 1
+        return future
+
+    def scan(self, content_hash, text, types):
+        return own_matches(self.submit_scan(content_hash, text, types).result())
+
 class DataContext:
-    def __init__(self, url, types, processed_urls = []):
-        self.url = url if url.endswith("/") else url + "/"
+    def __init__(self, url, types, options, state, resource_type = "page", depth = 0, locale = None):
+        if url.startswith("http"):
+            url = normalize_url(url)
+        self.url = url
+        # The Accept-Language this resource is requested with when crawling --locales
+        self.locale = locale
         self.data = {}
-        self.processed_urls = processed_urls
+        self.state = state
         self.types = types
+        # Future of a scan --scan-workers is still running, see types_result
+        self.pending_scan = None
         self.types_result = {}
+        self.match_elements = {}
+        self.match_attributes = {}
+        self.next_page = None
+        self.mixed_content = []
+        self.match_scores = {}
+        self.match_sightings = {}
+        self.inline_children = []
+        # The state file record of a resource being revalidated with --revalidate
+        self.cached = None
+        # Deepest level the subtree under this resource may reach with --adaptive-depth
+        self.allowance = None
+        # The page this resource was found on, sent as Referer with --send-referer
+        self.referer = None
+        # How many scripts, source maps and stylesheets were followed from the last page to get here
+        self.asset_hops = 1 if resource_type in ASSET_CHAIN_TYPES else 0
+        # The exception collecting this resource failed with, counted per host by --group-by host
+        self.error = None
+        self.options = options
+        self.resource_type = resource_type
+        self.depth = depth
+        with state.lock:
+            state.discovered[depth] += 1
+            state.frontier.push(self.key, resource_type, depth)
+            if url.startswith("http") and not state.in_scope(url):
+                state.external_links[urlsplit(url).hostname] += 1
+
+    def __repr__(self):
+        return "<DataContext %s %s>" % (self.resource_type, self.key)
+
+    @property
+    def key(self):
+        """What the resource is known as in the frontier and records
+
+        Pages crawled for each of --locales are told apart by their locale, everything
+        else they reference is fetched once, with the locale of the page found first.
+        """
+        if self.locale is None or self.resource_type not in PAGE_TYPES:
+            return self.url
+        return "%s [%s]" % (self.url, self.locale)
+
+    @property
+    def types_result(self):
+        # Matches of a scan handed to --scan-workers are waited for the first time they are needed
+        if self.pending_scan is not None:
+            with self.state.scan_lock:
+                if self.pending_scan is not None:
+                    self._types_result, self.pending_scan = own_matches(self.pending_scan.result()), None
+                    self.limit_match_length()
+                    self.score_matches()
+        return self._types_result
+
+    @types_result.setter
+    def types_result(self, value):
+        self.pending_scan = None
+        self._types_result = value
 
     def collect(self):
         # Do some work and store state
+        if self.resource_type == "file":
+            return self.collect_local()
+
+        if self.resource_type in ("inline", "archive-entry") or is_data_uri(self.url):
+            if self.state.frontier.pop(self.url):
+                self.load_inline()
+                self.state.record(self)
+                self.state.retain(self)
+                self.state.check_memory()
+                self.state.maybe_flush()
+            return []
+
         if not self.url.startswith('http'):
             return []
 
-        if self.url in self.processed_urls:
+        if self.state.frontier.seen(self.key):
+            return []
+
+        # Stopped from the --interactive-on-match prompt, what is left is only drained
+        if self.state.stopped:
+            self.data['status'] = "not crawled (stopped)"
+            return []
+
+        # Off-scope redirect targets are only listed, never fetched
+        if self.resource_type == "off-scope":
+            self.data['status'] = "not crawled"
+            return []
+
+        if self.options.respect_robots and not self.robots_allowed():
+            self.data['status'] = "disallowed by robots.txt"
             return []
 
-        self.data['content'] = requests.get(self.url, headers=headers).text
-        for k in self.types.keys():
-            self.types_result[k] = re.findall(self.types[k], self.data['content'])
+        if self.options.adaptive_depth:
+            # Seeds and resumed resources haven't been given an allowance by a parent
+            if self.allowance is None:
+                self.allowance = max(self.options.adaptive_min_depth, self.depth)
+            if self.depth > self.allowance:
+                self.data['status'] = "beyond adaptive depth"
+                with self.state.lock:
+                    self.state.stats["adaptive_skipped"] += 1
+                return []
+
+        if self.asset_hops > self.options.script_depth:
+            self.data['status'] = "beyond --script-depth"
+            with self.state.lock:
+                self.state.stats["script_depth_skipped"] += 1
+            return []
+
+        if self.depth > 0 and self.state.excluded_domain(self.url):
+            self.data['status'] = "excluded domain"
+            with self.state.lock:
+                self.state.stats["excluded_domain"] += 1
+            return []
+
+        if self.depth > 0 and self.options.max_same_url_params > 0:
+            param = self.state.exploding_param(self.url, self.options.max_same_url_params)
+            if param is not None:
+                debug("Skipping %s, %d values of ?%s= were crawled already" % (self.url, self.options.max_same_url_params, param))
+                self.data['status'] = "skipped (too many values of ?%s=)" % param
+                with self.state.lock:
+                    self.state.stats["param_values_skipped"] += 1
+                return []
+
+        # Seeds are always crawled, everything found from them has to be under a --path-prefix
+        if self.depth > 0 and not self.in_path_scope():
+            self.data['status'] = "outside path prefix"
+            with self.state.lock:
+                self.state.stats["outside_path_prefix"] += 1
+            return []
+
+        links = self.crawl()
+        if self.options.interactive_on_match and any(self.types_result.values()):
+            if self.state.ask_on_match(self) != "continue":
+                links = []
+        children = self.inline_children + [DataContext(link, self.types, self.options, self.state, resource_type, self.depth + 1, self.locale) for link, resource_type in links]
+
+        if self.options.single_page:
+            return self.collect_page_resources(children)
+
+        if self.options.follow_pagination:
+            children = self.follow_pagination() + children
+
+        if self.options.probe_common_paths:
+            children += self.probes()
+
+        if self.options.prefetch_dns:
+            self.state.prefetch_dns(child.url for child in children)
+
+        if self.options.adaptive_depth:
+            allowance = self.child_allowance()
+            for child in children:
+                child.allowance = allowance
+
+        for child in children:
+            # Links found on pages of a pagination chain already know the page they came from
+            if child.referer is None:
+                child.referer = self.url
+            if child.resource_type in ASSET_CHAIN_TYPES:
+                child.asset_hops = self.asset_hops + 1
+
+        self.state.check_memory()
+        self.state.maybe_flush()
+        return children
+
+    def collect_page_resources(self, children):
+        # The resources a seed page references are fetched right away so --depth 1 is enough,
+        # what they link to in turn and every other page are dropped
+        resources = [child for child in children if child.resource_type not in PAGE_TYPES + ("off-scope", "probe")]
+        for resource in resources:
+            if resource.resource_type != "inline":
+                resource.collect()
+        return resources
+
+    def child_allowance(self):
+        """How deep the subtree below this resource may go with --adaptive-depth
+
+        Every resource with findings lets the crawl reach --adaptive-step levels past it,
+        up to --adaptive-max-depth. Every barren one takes a level back off the reach it
+        inherited, down to --adaptive-min-depth, so sections that stop yielding anything
+        are abandoned and those that keep yielding are followed further.
+        """
+        if any(self.types_result.values()):
+            return min(self.options.adaptive_max_depth, max(self.allowance, self.depth + self.options.adaptive_step))
+        return max(self.options.adaptive_min_depth, self.allowance - 1)
+
+    def collect_local(self):
+        # A directory is walked whole and its files read right away, so -d 1 covers the whole tree
+        if not self.state.frontier.pop(self.url):
+            return []
+
+        if not os.path.isdir(self.url):
+            self.load_file()
+            self.state.record(self)
+            return []
+
+        self.data['status'] = "directory"
+        files = []
+        for root, directories, names in os.walk(self.url):
+            directories[:] = sorted(d for d in directories if d not in SKIPPED_DIRECTORIES)
+            for name in sorted(names):
+                context = DataContext(os.path.join(root, name), self.types, self.options, self.state, "file", self.depth + 1)
+                context.collect()
+                files.append(context)
+        self.state.maybe_flush()
+        return files
+
+    def load_file(self):
+        with self.state.lock:
+            self.state.fetched[self.depth] += 1
+
+        try:
+            with open(self.url, "rb") as f:
+                data = f.read(self.options.max_document_size + 1)
+        except OSError as e:
+            self.data['status'] = "unreadable (%s)" % e.strerror
+            return
+
+        if len(data) > self.options.max_document_size:
+            self.data['status'] = "skipped (over --max-document-size)"
+            return
+        # Like grep, files with NUL bytes early on are taken to be binary
+        if b"\0" in data[:8192]:
+            self.data['status'] = "skipped (binary)"
+            return
 
-        return [DataContext(link, self.types, self.processed_urls) for link in self.extract_links()]
+        self.data['status'] = "read"
+        self.data['request'] = {"method": "", "final url": self.url, "content type": "", "fetched at": iso_time(time.time()), "fetcher": "file"}
+        self.data['content'] = data.decode("utf-8", errors="replace")
+        self.data['hash'] = hashlib.sha256(data).hexdigest()
+        self.data['length'] = len(data)
+        self.data['sha256'] = self.data['hash']
+        if self.types:
+            self.types_result = self.state.scan(self.data['hash'], self.data['content'], self.types)
+        self.limit_match_length()
+        self.score_matches()
+
+    def probes(self):
+        # Every in-scope host is probed once, from the first of its resources to be crawled
+        host = urlsplit(self.url).hostname
+        with self.state.lock:
+            if host in self.state.probed_hosts or not self.state.in_scope(self.url):
+                return []
+            self.state.probed_hosts.add(host)
+
+        origin = "%s://%s/" % (urlsplit(self.url).scheme, urlsplit(self.url).netloc)
+        return [DataContext(urljoin(origin, path), self.types, self.options, self.state, "probe", self.depth + 1) for path in self.state.probe_paths]
+
+    def robots_allowed(self):
+        robots = self.state.robots_for(self.url, (self.options.connect_timeout, self.options.timeout))
+        return robots is None or robots.can_fetch(self.state.session.headers["User-Agent"], self.url)
+
+    def crawl_delay(self):
+        if self.options.crawl_delay is not None:
+            return self.options.crawl_delay
+        if not self.options.respect_robots or self.options.ignore_crawl_delay:
+            return 0
+
+        robots = self.state.robots_for(self.url, (self.options.connect_timeout, self.options.timeout))
+        delay = robots.crawl_delay(self.state.session.headers["User-Agent"]) if robots is not None else None
+        return float(delay or 0)
+
+    def in_path_scope(self):
+        if not self.options.path_prefix:
+            return True
+        path = urlsplit(self.url).path or "/"
+        return any(path.startswith(prefix) for prefix in self.options.path_prefix)
+
+    def crawl(self):
+        self.fetch()
+        for _ in range(self.options.retry_truncated):
+            if 'truncated' not in self.data:
+                break
+            debug("Fetching %s again, it was truncated" % self.url)
+            with self.state.lock:
+                self.state.stats["truncated_retries"] += 1
+            del self.data['truncated']
+            self.fetch()
+        with self.state.lock:
+            self.state.fetched[self.depth] += 1
+            if not self.state.in_scope(self.url):
+                self.state.external_contacted.add(urlsplit(self.url).hostname)
+
+        links = self.extract_links()
+        if self.options.extract_inline and self.resource_type in PAGE_TYPES and 'content' in self.data and self.parses_as_html():
+            self.inline_children = self.extract_inline_blocks()
+        if 'archive_entries' in self.data:
+            self.inline_children += self.collect_archive_entries()
+        limit = self.options.max_links_per_page
+        if limit > 0 and len(links) > limit:
+            # Link bombs only get their first links followed
+            debug("Skipping %d of the %d links on %s" % (len(links) - limit, len(links), self.url))
+            with self.state.lock:
+                self.state.stats["links_skipped"] += len(links) - limit
+            links = links[:limit]
+
+        if self.data.get('off_scope'):
+            # A followed off-scope redirect is scanned but not recursed into
+            links = []
+        elif 'off_scope_redirect' in self.data:
+            links.append((self.data['off_scope_redirect'], "off-scope"))
+
+        self.state.record(self)
+        self.state.retain(self)
+        return links
+
+    def extract_inline_blocks(self):
+        # Blocks are scanned right away rather than queued, so the ones on pages at the depth limit aren't lost
+        blocks = []
+        spans = []
+        counts = Counter()
+        for m in INLINE_BLOCK.finditer(self.data['content']):
+            kind = m.lastgroup
+            if not m.group(kind).strip():
+                continue
+            counts[kind] += 1
+            spans.append(m.span(kind))
+            url = self.state.add_inline_block(self.url, "%s-%d" % (kind, counts[kind]), m.group(kind), self.options.dedupe_inline)
+            if url is not None:
+                block = DataContext(url, self.types, self.options, self.state, "inline", self.depth + 1)
+                block.collect()
+                blocks.append(block)
+
+        # Matches inside the blocks are reported on the blocks, not again on every page carrying them
+        self.types_result = {k: [m for m in matches if not any(start <= m.start < end for start, end in spans)] for k, matches in self.types_result.items()}
+        return blocks
+
+    def collect_archive_entries(self):
+        # Like inline blocks the entries are scanned right away, the archive is not kept around
+        entries = []
+        for path, content in self.data.pop('archive_entries'):
+            url = self.state.add_archive_entry(self.url, path, content)
+            entry = DataContext(url, self.types, self.options, self.state, "archive-entry", self.depth + 1)
+            entry.collect()
+            entries.append(entry)
+        return entries
+
+    def follow_pagination(self):
+        # The whole chain is fetched at this depth so a long listing doesn't use up --depth,
+        # the returned pages are already crawled and only their links are followed later
+        pages = []
+        seen = {self.url}
+        page = self
+        while page.next_page and len(seen) < self.options.max_pages_per_list:
+            previous = page
+            page = DataContext(previous.next_page, self.types, self.options, self.state, "page", self.depth, self.locale)
+            if page.url in seen or self.state.frontier.seen(page.key):
+                with self.state.lock:
+                    self.state.stats["pagination_loops"] += 1
+                break
+
+            seen.add(page.url)
+            page.referer = previous.url
+            links = page.crawl()
+            pages.append(page)
+            pages.extend(page.inline_children)
+            for link, resource_type in links:
+                child = DataContext(link, self.types, self.options, self.state, resource_type, self.depth + 1, self.locale)
+                child.referer = page.url
+                pages.append(child)
+
+        return pages
+
+    def get(self, request_headers):
+        # Redirects are followed by hand so hops leaving the crawl scope are caught
+        url = self.url
+        # --method and --data only apply to the seeds, links found while crawling are plain GETs
+        method, body = ("GET", None) if self.depth > 0 else (self.options.method, self.options.body)
+        for _ in range(MAX_REDIRECTS):
+            timeout = (self.options.connect_timeout, self.options.timeout)
+            response = self.state.session.request(method, url, headers=request_headers, data=body, stream=True, allow_redirects=False, timeout=timeout)
+            if self.options.report_certs:
+                self.record_certificate(url, response)
+            if not response.is_redirect:
+                return response
+
+            # Like browsers, a redirected POST turns into a GET without a body
+            if response.status_code == 303 or (response.status_code in (301, 302) and method == "POST"):
+                method, body = "GET", None
+
+            location = urljoin(url, response.headers["Location"])
+            if not self.state.in_scope(location) and not self.data.get('off_scope'):
+                self.data['off_scope_redirect'] = location
+                with self.state.lock:
+                    self.state.stats["off_scope_redirects"] += 1
+                if not self.options.allow_redirect_to_external:
+                    return response
+                self.data['off_scope'] = True
+
+            response.close()
+            url = location
+
+        return response
+
+    def record_certificate(self, url, response):
+        host = urlsplit(url).hostname
+        if not url.startswith("https") or host in self.state.certificates:
+            return
+
+        sock = peer_socket(response)
+        if sock is None:
+            return
+
+        with self.state.lock:
+            self.state.certificates[host] = sock.getpeercert()
+
+    def load_inline(self):
+        # data: URIs carry their content, they are decoded and scanned instead of fetched
+        with self.state.lock:
+            self.state.fetched[self.depth] += 1
+
+        block = self.state.inline_blocks.get(self.url)
+        if block is not None:
+            self.data['content'] = block["content"]
+            data = block["content"].encode()
+        else:
+            try:
+                media_type, charset, data = parse_data_uri(self.url)
+            except ValueError as e:
+                self.data['status'] = "invalid (%s)" % e
+                return
+
+            if media_type.startswith(BINARY_MEDIA_TYPES):
+                self.data['status'] = "skipped (%s)" % media_type
+                return
+            self.data['content'] = data.decode(charset if codec_exists(charset) else "utf-8", errors="replace")
+
+        self.data['status'] = "extracted" if self.resource_type == "archive-entry" else "inline"
+        self.data['request'] = {"method": "", "final url": self.url, "content type": "", "fetched at": iso_time(time.time()), "fetcher": self.data['status']}
+        self.data['hash'] = hashlib.sha256(data).hexdigest()
+        self.data['length'] = len(data)
+        self.data['sha256'] = self.data['hash']
+        if self.resource_type == "sourcemap":
+            self.expand_source_map()
+        elif self.types:
+            self.types_result = self.state.scan(self.data['hash'], self.data['content'], self.types)
+        self.limit_match_length()
+        self.score_matches()
+
+    def referer_header(self):
+        if not self.options.send_referer:
+            return None
+        # Seeds weren't found on any page, they get --seed-referer if anything
+        referer = self.referer if self.referer is not None else self.options.seed_referer
+        # Like browsers, https pages aren't leaked to plain http urls
+        if referer and referer.startswith("https:") and self.url.startswith("http:"):
+            return None
+        return referer
+
+    def body_chunks(self, response):
+        # A connection dropped mid-body ends the body early instead of failing the resource,
+        # what arrived is still scanned and the resource is reported as truncated
+        try:
+            yield from response.iter_content(chunk_size=CHUNK_SIZE)
+        except requests.exceptions.ChunkedEncodingError:
+            self.data['truncated'] = ""
+
+    def excluded_content_type(self, response):
+        """The content type of the response when it is excluded from scanning, None otherwise"""
+        content_type = response.headers.get("Content-Type", "").split(";")[0].strip().lower()
+        if content_type and any(fnmatch.fnmatchcase(content_type, excluded) for excluded in self.options.excluded_content_types):
+            return content_type
+        return None
+
+    def excluded_by_head(self, request_headers):
+        # A HEAD request tells the content type before anything is downloaded, servers
+        # that don't answer it are fetched as usual
+        try:
+            response = self.state.session.head(self.url, headers=request_headers, allow_redirects=True, timeout=(self.options.connect_timeout, self.options.timeout))
+        except requests.RequestException:
+            return False
+        content_type = self.excluded_content_type(response) if response.ok else None
+        if content_type:
+            self.data['status'] = response.status_code
+            self.skip_content_type(content_type)
+        return content_type is not None
+
+    def skip_content_type(self, content_type):
+        self.data['status'] = "skipped (%s)" % content_type
+        self.data['content'] = ""
+        with self.state.lock:
+            self.state.stats["content_type_excluded"] += 1
+
+    def older_than_since(self, response):
+        last_modified = response.headers.get("Last-Modified")
+        if not last_modified:
+            return self.options.since_missing == "exclude"
+        try:
+            return parsedate_to_datetime(last_modified).timestamp() < self.options.since
+        except (TypeError, ValueError):
+            return self.options.since_missing == "exclude"
+
+    def reuse_cached(self):
+        self.data['status'] = self.cached["status"]
+        self.data['etag'] = self.data.get('etag') or self.cached.get("etag")
+        self.data['last_modified'] = self.data.get('last_modified') or self.cached.get("last_modified")
+        self.data['sha256'] = self.cached.get("sha256")
+        self.data['not_modified'] = True
+        content = self.cached.get("content")
+        if content is not None and self.types:
+            # Stored content is scanned again, the patterns may have changed since it was crawled
+            self.data['content'] = content
+            self.data['hash'] = hashlib.sha256(content.encode()).hexdigest()
+            self.types_result = self.state.scan(self.data['hash'], content, self.types)
+            return
+        self.data['content'] = ""
+        self.types_result = {k: [Match(*m) for m in v] for k, v in self.cached["matches"].items()}
+
+    def expand_source_map(self):
+        # The original sources embedded in the map are scanned in place of its JSON
+        try:
+            source_map = json.loads(self.data['content'])
+        except ValueError:
+            self.data['status'] = "%s (not a source map)" % self.data['status']
+            return
+
+        sources = source_map.get("sources") or []
+        parts = []
+        for index, content in enumerate(source_map.get("sourcesContent") or []):
+            if content:
+                name = sources[index] if index < len(sources) else "source %d" % index
+                parts.append("// source: %s\n%s" % (name, content))
+
+        self.data['content'] = "\n".join(parts)
+        self.data['hash'] = hashlib.sha256(self.data['content'].encode()).hexdigest()
+        if self.types:
+            self.types_result = self.state.scan(self.data['hash'], self.data['content'], self.types)
+
+    def limit_match_length(self):
+        # Applied after the scan so the cached results shared between identical bodies stay complete
+        limit = self.options.drop_matches_over
+        if limit <= 0:
+            return
+
+        limited = {}
+        too_long = 0
+        for k, matches in self.types_result.items():
+            limited[k] = []
+            for m in matches:
+                if len(m.value) <= limit:
+                    limited[k].append(m)
+                    continue
+                too_long += 1
+                if self.options.truncate_long_matches:
+                    limited[k].append(m._replace(value="%s...[+%d chars]" % (m.value[:limit], len(m.value) - limit)))
+        self.types_result = limited
+
+        if too_long:
+            with self.state.lock:
+                self.state.stats["too_long"] += too_long
+
+    def score_matches(self):
+        if not self.options.confidence and self.options.min_confidence <= 0:
+            return
+
+        content = self.content()
+        for k, matches in self.types_result.items():
+            kept = []
+            for m in matches:
+                score = confidence(m, content)
+                if score >= self.options.min_confidence:
+                    self.match_scores[m] = score
+                    kept.append(m)
+            self.types_result[k] = kept
+
+    def parses_as_html(self):
+        """Whether the page is parsed as HTML, by its Content-Type when it has one"""
+        if self.options.no_html_parse:
+            return False
+        content_type = self.data.get('request', {}).get("content type", "").split(";")[0].strip().lower()
+        return not content_type or content_type in HTML_CONTENT_TYPES
+
+    def needs_content(self):
+        # Whether links are extracted from the body once it is downloaded
+        if self.options.no_html_parse:
+            return False
+        return self.resource_type in PAGE_TYPES or \
+            (self.resource_type == "stylesheet" and self.options.crawl_css) or \
+            (self.resource_type in ("script", "preload") and (self.options.follow_source_maps or self.options.js_links))
+
+    def fetch(self):
+        request_headers = {}
+        if self.options.range:
+            request_headers["Range"] = self.options.range
+
+        if self.options.throttle_on_match:
+            self.state.throttle(self.options.throttle_delay)
+
+        delay = self.crawl_delay()
+        if delay > 0:
+            self.state.wait_for_host(self.url, delay)
+
+        referer = self.referer_header()
+        if referer:
+            request_headers["Referer"] = referer
+
+        accept_language = self.locale or self.options.accept_language
+        if accept_language:
+            request_headers["Accept-Language"] = accept_language
+
+        user_agent = self.state.user_agent(self.url)
+        if user_agent:
+            request_headers["User-Agent"] = user_agent
+            debug("Fetching %s as %s" % (self.url, user_agent))
+
+        if self.cached is not None:
+            if self.cached.get("etag"):
+                request_headers["If-None-Match"] = self.cached["etag"]
+            if self.cached.get("last_modified"):
+                request_headers["If-Modified-Since"] = self.cached["last_modified"]
+
+        with self.state.fetch_slots:
+            self.download(request_headers)
+
+    def download(self, request_headers):
+        if self.options.head_first and self.excluded_by_head(request_headers):
+            return
+
+        # Servers without range support answer 200 with the full body, which is scanned as usual
+        started = time.time()
+        response = self.get(request_headers)
+        self.data['status'] = response.status_code
+        self.data['request'] = {
+            "method": response.request.method,
+            "final url": response.url,
+            "content type": response.headers.get("Content-Type", ""),
+            "fetched at": iso_time(started),
+            "fetcher": "http",
+        }
+        self.data['etag'] = response.headers.get("ETag")
+        self.data['last_modified'] = response.headers.get("Last-Modified")
+
+        if self.cached is not None and response.status_code == 304:
+            # Unchanged since the last crawl, its findings are reused and nothing is downloaded
+            response.close()
+            self.reuse_cached()
+            with self.state.lock:
+                self.state.stats["not_modified"] += 1
+            return
+        if self.cached is not None:
+            with self.state.lock:
+                self.state.stats["refetched"] += 1
+
+        if self.options.collapse_login_redirects and response.url != self.url and \
+                self.state.redirected_to_login(self.url, response.url, self.options.login_redirect_threshold):
+            # The same login page again, it was scanned the first time
+            response.close()
+            self.data['status'] = "requires authentication"
+            self.data['content'] = ""
+            return
+
+        content_type = self.excluded_content_type(response)
+        if content_type:
+            # Decided from the headers alone, the body is never read
+            response.close()
+            self.skip_content_type(content_type)
+            return
+
+        stale = self.options.since is not None and self.older_than_since(response)
+        if stale:
+            self.data['stale'] = True
+            with self.state.lock:
+                self.state.stats["older_than_since"] += 1
+            # The body is only worth downloading when links are still followed from it
+            if self.options.since_no_recurse or not self.needs_content():
+                response.close()
+                self.data['content'] = ""
+                return
+        self.data['partial'] = response.status_code == 206
+        # The charset comes from the server, one python doesn't know is read as utf-8
+        encoding = response.encoding if response.encoding and codec_exists(response.encoding) else "utf-8"
+        decoder = None
+        scanner = ChunkScanner(self.types, self.options.max_match_len)
+        max_body_size = self.options.max_body_size
+        # Bodies that are kept whole are scanned afterwards so the scan can be cached by hash,
+        # source maps always are since they have to be parsed in full
+        # documents are buffered whole too, their text is only readable once extracted
+        document = document_kind(response) if self.options.scan_documents else None
+        archive = archive_kind(response) if self.options.scan_archives and document is None else None
+        streaming = (max_body_size > 0 or self.options.stream) and self.resource_type != "sourcemap" and document is None and archive is None
+        hasher = hashlib.sha256()
+
+        # The whole body is scanned, but only the first max-body-size bytes are kept for parsing.
+        # With --stream nothing is kept of bodies no links are extracted from.
+        keep = None
+        if streaming and max_body_size > 0:
+            keep = max_body_size
+        elif streaming and not self.needs_content():
+            keep = 0
+        body = bytearray()
+        length = 0
+        cut_short = False
+        for chunk in self.body_chunks(response):
+            # The read timeout only bounds single reads, a slow drip of data is cut off here
+            if time.time() - started > self.options.timeout:
+                response.close()
+                raise requests.Timeout("%s took longer than %ss" % (self.url, self.options.timeout))
+            hasher.update(chunk)
+            length += len(chunk)
+            if decoder is None:
+                # Strip a leading BOM so it reaches neither the parser nor patterns anchored at ^
+                bom_encoding, bom_length = sniff_bom(chunk)
+                if bom_encoding:
+                    encoding, chunk = bom_encoding, chunk[bom_length:]
+                decoder = codecs.getincrementaldecoder(encoding)(errors="replace")
+            if streaming:
+                scanner.feed(decoder.decode(chunk))
+            if keep is None or len(body) < keep:
+                body.extend(chunk)
+            if document and len(body) > self.options.max_document_size:
+                response.close()
+                self.data['document'] = "%s (over --max-document-size, not extracted)" % document
+                document = None
+                cut_short = True
+                break
+            if archive and len(body) > self.options.max_archive_size:
+                response.close()
+                self.data['archive'] = "%s (over --max-archive-size, not extracted)" % archive
+                with self.state.lock:
+                    self.state.stats["archive_limited"] += 1
+                archive = None
+                cut_short = True
+                break
+
+        if keep is not None:
+            body = body[:keep]
+
+        # Compressed bodies are counted decoded, only plain ones can be held against Content-Length
+        declared = response.headers.get("Content-Length", "")
+        short = declared.isdigit() and not response.headers.get("Content-Encoding") and length < int(declared)
+        if not cut_short and (short or 'truncated' in self.data):
+            self.data['truncated'] = "got %d of %s bytes" % (length, declared or "the")
+            debug("Truncated response from %s: %s" % (self.url, self.data['truncated']))
+
+        self.data['content'] = body.decode(encoding, errors="replace")
+        self.data['hash'] = hasher.hexdigest()
+        # What was downloaded, kept apart from the hash of the scanned text which source maps replace
+        self.data['length'] = length
+        self.data['sha256'] = self.data['hash']
+
+        if document:
+            self.data['document'] = document
+            try:
+                self.data['content'] = extract_document_text(document, bytes(body))
+            except Exception as e:
+                # A broken document is still scanned as whatever text its raw bytes hold
+                debug("Failed to extract text from %s: %s" % (self.url, e))
+                self.data['document'] = "%s (extraction failed)" % document
+
+        if archive:
+            # The archive itself is binary, only the entries read from it are scanned
+            self.data['archive'] = archive
+            self.data['content'] = ""
+            stats = Counter()
+            try:
+                name = urlsplit(self.url).path.rsplit("/", 1)[-1]
+                self.data['archive_entries'] = extract_archive_entries(archive, bytes(body), name, self.options.max_archive_entries, self.options.max_archive_size, stats)
+            except Exception as e:
+                debug("Failed to read archive %s: %s" % (self.url, e))
+                self.data['archive'] = "%s (unreadable)" % archive
+            with self.state.lock:
+                self.state.stats.update(stats)
+
+        if self.resource_type == "sourcemap":
+            self.expand_source_map()
+        elif not self.types or stale:
+            self.types_result = {}
+        elif streaming:
+            if decoder is not None:
+                scanner.feed(decoder.decode(b"", final=True))
+            self.types_result = scanner.finish()
+            with self.state.lock:
+                self.state.stats["scans"] += 1
+        elif self.state.scan_pool is not None and not self.options.throttle_on_match:
+            # This worker moves on to the links while a --scan-workers process scans the body,
+            # the matches are filtered once they are read
+            self.pending_scan = self.state.submit_scan(self.data['hash'], self.data['content'], self.types)
+            return
+        else:
+            self.types_result = self.state.scan(self.data['hash'], self.data['content'], self.types)
+
+        self.limit_match_length()
+        self.score_matches()
+
+        if self.options.throttle_on_match and any(self.types_result.values()):
+            self.state.start_cooldown(self.options.throttle_cooldown)
 
     def extract_links(self):
-        if self.url in self.processed_urls:
+        if not self.state.frontier.pop(self.key):
             return []
 
-        self.processed_urls.append(self.url)
+        if 'document' in self.data or 'archive' in self.data or self.options.no_html_parse:
+            return []
+
+        if self.resource_type == "stylesheet":
+            return self.extract_css_links(self.data['content'])
+
+        if self.resource_type in ("script", "preload"):
+            return self.extract_source_map_links(self.data['content']) + self.extract_js_links([self.data['content']])
+
+        if self.resource_type not in PAGE_TYPES:
+            return []
+
+        if not self.parses_as_html():
+            with self.state.lock:
+                self.state.stats["not_html"] += 1
+            return []
 
         soup = bs4.BeautifulSoup(self.data['content'], 'html.parser')
-        hrefs = []
+        if self.options.scan_attributes and self.types:
+            self.scan_attributes(soup)
+        if self.options.match_context_html:
+            self.locate_matches(soup)
+        if self.options.follow_pagination:
+            self.next_page = find_next_page(soup, self.url)
+        if self.options.report_mixed_content and self.url.startswith("https://"):
+            self.mixed_content = find_mixed_content(soup, self.url)
+
+        # html.parser keeps <template> contents in the tree, so links inside them are found like any other
+        links = []
+        for tag in soup.find_all(True):
+            for attribute in ("src", "href"):
+                value = tag.get(attribute)
+                if is_data_uri(value):
+                    links.append((value.strip(), "inline"))
+
         for link in soup.find_all('a'):
             href = link.get('href')
-            if href:
-                if href.startswith('/') or href.startswith("#"):
-                    hrefs.append(self.url + href)
-                else:
-                    hrefs.append(href)
-        return hrefs
+            if href and not is_data_uri(href):
+                links.append((urljoin(self.url, href), "page"))
+
+        if self.options.crawl_scripts:
+            for script in soup.find_all('script'):
+                src = script.get('src')
+                if src and not is_data_uri(src):
+                    links.append((urljoin(self.url, src), "script"))
+
+        for link in soup.find_all('link'):
+            href = link.get('href')
+            rels = set(link.get('rel') or [])
+            if not href or is_data_uri(href):
+                continue
+
+            if rels & PRELOAD_RELS:
+                links.append((urljoin(self.url, href), "preload"))
+            elif "import" in rels:
+                # HTML imports are documents of their own, crawled like any page
+                links.append((urljoin(self.url, href), "page"))
+            elif "stylesheet" in rels and self.options.crawl_css:
+                links.append((urljoin(self.url, href), "stylesheet"))
+
+        if self.options.crawl_css:
+            for style in soup.find_all('style'):
+                links.extend(self.extract_css_links(style.get_text()))
+
+        links.extend(self.extract_js_links(script.get_text() for script in soup.find_all('script') if not script.get('src')))
+        return links
+
+    def extract_js_links(self, scripts):
+        # A guess at the links a script builds, bounded since minified bundles are full of paths
+        if not self.options.js_links:
+            return []
+
+        links = []
+        cross_origin = 0
+        host = urlsplit(self.url).hostname
+        candidates = (candidate for script in scripts for candidate in JS_URL.findall(script))
+        for candidate in candidates:
+            if len(links) >= self.options.max_js_links:
+                break
+            url = urljoin(self.url, candidate)
+            if not url.startswith("http") or urlsplit(url).path.lower().endswith(JS_LINK_SKIPPED):
+                continue
+            # APIs on other hosts are only followed when they are part of the scope
+            if urlsplit(url).hostname != host and not self.state.in_declared_scope(url):
+                cross_origin += 1
+                continue
+            if (url, "js-link") not in links:
+                links.append((url, "js-link"))
+
+        with self.state.lock:
+            self.state.stats["js_links"] += len(links)
+            self.state.stats["js_links_out_of_scope"] += cross_origin
+        return links
+
+    def extract_source_map_links(self, script):
+        if not self.options.follow_source_maps:
+            return []
+
+        # The last annotation wins, bundlers append theirs at the very end
+        references = SOURCE_MAPPING_URL.findall(script)
+        if not references:
+            return []
+        reference = references[-1]
+        return [(reference if is_data_uri(reference) else urljoin(self.url, reference), "sourcemap")]
+
+    def extract_css_links(self, css):
+        if not self.options.crawl_css:
+            return []
+
+        links = []
+        for href in CSS_IMPORT_PATTERN.findall(css):
+            links.append((urljoin(self.url, href), "stylesheet"))
+
+        for href in CSS_URL_PATTERN.findall(css):
+            if href.startswith("data:"):
+                links.append((href, "inline"))
+                continue
+            resource_type = "stylesheet" if href.split("?")[0].endswith(".css") else "asset"
+            links.append((urljoin(self.url, href), resource_type))
+
+        return links
+
+    def scan_attributes(self, soup):
+        # Attribute values are scanned with their character references decoded, a secret written
+        # as &#65;KIA... is only found there. Matches are listed with the attribute they are in
+        content = self.data.get('content', "")
+        found = 0
+        for tag in soup.find_all(True):
+            for attribute, value in tag.attrs.items():
+                # Multi-valued attributes like class come back as lists
+                if isinstance(value, list):
+                    value = " ".join(value)
+                if not value:
+                    continue
+                position = (tag.sourceline or 1, tag.sourcepos or 0)
+                for k, matches in scan_text(value, self.types, self.state.whitespace).items():
+                    for m in matches:
+                        # The same value in the raw content, the first one from the tag on that isn't placed yet
+                        located = next((n for n in self.types_result.get(k, []) if n.value == m.value and n not in self.match_attributes and (n.line, n.column - 1) >= position), None)
+                        if located is None:
+                            # Not in the raw content, placed past its end like streamed matches so
+                            # it gets no text context, at the line and column of its tag
+                            located = Match(m.value, len(content), len(content) + len(m.value), position[0], position[1] + 1)
+                            if self.options.confidence or self.options.min_confidence > 0:
+                                score = confidence(located, content)
+                                if score < self.options.min_confidence:
+                                    continue
+                                self.match_scores[located] = score
+                            self.types_result.setdefault(k, []).append(located)
+                        self.match_attributes[located] = "%s[%s]" % (describe_element(tag), attribute)
+                        found += 1
+
+        with self.state.lock:
+            self.state.stats["attribute_matches"] += found
+
+    def locate_matches(self, soup):
+        # html.parser records where every start tag begins, the last tag starting before
+        # a match is the innermost candidate for the element holding it
+        tags = [tag for tag in soup.find_all(True) if tag.sourceline is not None]
+        positions = [(tag.sourceline, tag.sourcepos) for tag in tags]
+        for matches in self.types_result.values():
+            for m in matches:
+                index = bisect.bisect_right(positions, (m.line, m.column - 1)) - 1
+                if index >= 0:
+                    element = enclosing_element(tags[index], m.value)
+                    if element is not None:
+                        self.match_elements[m] = describe_element(element)
+
+    def content(self):
+        # Content spilled to disk under --max-memory is read back when needed
+        if 'spilled' in self.data:
+            return self.state.spill_file.read(*self.data['spilled'])
+        return self.data.get('content', "")
+
+    def match_context(self, m, width):
+        element = self.match_elements.get(m)
+        if element is not None:
+            return "<%s>" % element
+
+        # Matches that could not be tied to an element get the surrounding text instead
+        return self.text_context(m, width)
+
+    def text_context(self, m, width):
+        content = self.content()
+        if m.end > len(content):
+            return None
+        snippet = content[max(0, m.start - width):m.end + width]
+        if self.options.redact_output_content:
+            # Every match is masked, a window can also hold the secrets found next to this one
+            values = sorted({n.value for matches in self.types_result.values() for n in matches}, key=len, reverse=True)
+            for value in values:
+                snippet = snippet.replace(value, mask_secret(value, self.options.redact_reveal))
+        return '"%s"' % " ".join(snippet.split())
+
+    def format_match(self, m, k):
+        value = m.value
+        # Local files always get line numbers, they are what points at the finding
+        if self.options.match_line_numbers or self.resource_type == "file":
+            value = "%s (%d:%d)" % (value, m.line, m.column)
+        if m in self.match_scores:
+            value = "%s [confidence %d]" % (value, self.match_scores[m])
+        if m in self.match_sightings:
+            value = "%s %s" % (value, self.match_sightings[m])
+        if m in self.match_attributes:
+            value = "%s (in %s)" % (value, self.match_attributes[m])
+        # Patterns from --patterns-file can ask for more or less context than --context
+        width = self.options.pattern_context.get(k, self.options.context)
+        context = None
+        if self.options.match_context_html and self.resource_type in PAGE_TYPES:
+            context = self.match_context(m, width or TEXT_CONTEXT)
+        elif width > 0:
+            context = self.text_context(m, width)
+        if context:
+            value = "%s %s" % (value, context)
+        return value
 
     def process(self):
-        if len(self.types_result.keys()) > 0:
-            d = {"url": self.url[:80] }
+        # Only narrows the listing, every resource type is still crawled
+        if self.options.resource_type and self.resource_type not in self.options.resource_type:
+            return None
+
+        # Probes are only worth listing when the path exists, and when scanning only with matches
+        if self.resource_type == "probe":
+            if self.data.get('status') != 200:
+                return None
+            if not self.options.discover and not any(self.types_result.values()):
+                return None
+
+        # Like grep, local files are only listed when something matched
+        if self.resource_type == "file" and not self.options.discover and not any(self.types_result.values()):
+            return None
+
+        # Local scans list whole paths under a source column instead of urls
+        column, location = ("source", self.url) if self.resource_type == "file" else ("url", self.url[:80])
+        if self.options.discover:
+            if 'status' not in self.data:
+                return None
+            d = {column: location, "type": self.resource_type, "status": str(self.data['status'])}
+            if self.data.get('stale'):
+                d["status"] += " (older than --since)"
+        elif len(self.types_result.keys()) > 0:
+            d = {column: location, "type": self.resource_type }
+            if self.options.locales:
+                d["locale"] = self.locale or ""
             for k in self.types_result.keys():
-                d[k] = ', '.join(self.types_result[k])
-            return d
+                d[k] = ', '.join(self.format_match(m, k) for m in self.unique_matches(k))
         else:
             return None
 
-def _VALRADAR_INIT(args):
+        if self.options.report_mixed_content:
+            d["mixed content"] = ', '.join(self.mixed_content)
+        if self.options.extract_inline:
+            d["found on"] = self.found_on()
+        if self.options.verbose_findings:
+            # Everything needed to reproduce the request that produced the row
+            request = self.data.get('request', {})
+            for key in ("method", "final url", "content type", "fetched at", "fetcher"):
+                d[key] = request.get(key, "")
+            d["status"] = str(self.data.get('status', ""))
+        return d
+
+    def unique_matches(self, k):
+        if not self.options.dedupe_matches and not self.options.dedupe_across_types:
+            return self.types_result[k]
+
+        # Every match is only listed on the first resource it was found on, with where else it was
+        index = self.state.first_sightings(self.options.dedupe_across_types)
+        kept = []
+        for m in self.types_result[k]:
+            key = (k, m.value) if self.options.dedupe_across_types else (k, m.value, self.resource_type)
+            sighting = index.get(key)
+            if sighting is None:
+                kept.append(m)
+            elif sighting["url"] == self.key:
+                kept.append(m)
+                if len(sighting["resources"]) > 1:
+                    self.match_sightings[m] = "[%d resources: %s]" % (len(sighting["resources"]), ", ".join(sorted(sighting["types"])))
+        return kept
+
+    def found_on(self):
+        block = self.state.inline_blocks.get(self.url)
+        if block is None:
+            return ""
+        pages = block["pages"]
+        if len(pages) > 3:
+            return "%s and %d more pages" % (", ".join(pages[:3]), len(pages) - 3)
+        return ", ".join(pages)
+
+def build_parser():
     parser = argparse.ArgumentParser("web.regex", description="D")
-    parser.add_argument("url", help="The url to initiate scraping on")
-    parser.add_argument("-t", "--type", help="A mapping of a type to a regex that matches it -t letters='[a-zA-Z]'", action="append", default=[])
+    parser.add_argument("url", help="The url to initiate scraping on, - reads one url per line from stdin. A file:// url or local path scans that file or directory tree instead", nargs="?")
+    parser.add_argument("-t", "--type", "-p", "--pattern", dest="type", help="A mapping of a type to a regex that matches it -t letters='[a-zA-Z]', unnamed regexes are labelled pattern_N", action="append", default=[])
+    parser.add_argument("--patterns-file", help='JSON file of more patterns, {"name": "regex"} or {"name": {"pattern": "regex", "context": 200}} to show a different --context for it')
+    parser.add_argument("--context", help="Show this many characters of text on both sides of every match, 0 shows none", type=int, default=0)
+    parser.add_argument("--contains", help="Like -t but the text is matched literally, --contains token=ghp_ needs no escaping", action="append", default=[])
+    parser.add_argument("--whole-word", help="Only match patterns and --contains terms that aren't part of a longer word", action="store_true")
+    parser.add_argument("--normalize-whitespace", help="Collapse every run of whitespace to a single space before matching, or with 'remove' drop it, so patterns with spaces match however the HTML is minified or reflowed. Matches are listed as the pattern saw them, at their place in the original content", nargs="?", choices=["collapse", "remove"], const="collapse")
+    parser.add_argument("--anchor", help="Only match patterns and --contains terms at the start or end of a line, or spanning a whole one", choices=["start", "end", "line"])
+    parser.add_argument("--expand", help="Expand {start-end} ranges and {a,b,c} alternatives in the seed urls into every combination", action="store_true")
+    parser.add_argument("--max-expanded", help="Most urls --expand generates", type=int, default=10000)
+    parser.add_argument("--discover", help="Only list the resources the site exposes with their types and status codes, -t is not needed", action="store_true")
+    parser.add_argument("--resource-type", help="Only list resources of this type in the output, can be repeated", choices=RESOURCE_TYPES, action="append", default=[])
+    parser.add_argument("--match-line-numbers", help="Show the line:column of every match within the fetched content", action="store_true")
+    parser.add_argument("--confidence", help="Score every match from 0 to 100 by how much its surroundings look like a secret", action="store_true")
+    parser.add_argument("--min-confidence", help="Drop matches scoring below this, implies --confidence", type=int, default=0)
+    parser.add_argument("--match-context-html", help="Show the tag, id and classes of the HTML element holding every match on a page, falls back to the surrounding text", action="store_true")
+    parser.add_argument("--verbose-findings", help="Add the method, final url, status, content type, time and fetcher of the request behind every row", action="store_true")
+    parser.add_argument("--coverage", help="Summarize how many resources were fetched and skipped (duplicates or depth limit) at each depth", action="store_true")
+    parser.add_argument("--group-by", help="Summarize the crawl per host: resources crawled, matches by pattern, errors and bytes downloaded", choices=["host"])
+    parser.add_argument("--group-sort", help="Order of the --group-by rows, counts are sorted largest first", choices=sorted(HOST_SORT_KEYS.keys()), default="matches")
+    parser.add_argument("--probe-common-paths", help="Request well known sensitive paths (/.env, /.git/config, backups...) on every crawled host and list the ones that exist", action="store_true")
+    parser.add_argument("--probe-wordlist", help="File with one path per line to probe instead of the built-in list, implies --probe-common-paths")
+    parser.add_argument("--report-mixed-content", help="List the http:// subresources referenced by every https page", action="store_true")
+    parser.add_argument("--report-external-domains", help="Summarize links to hosts other than the seed hosts, with counts and whether they were requested", action="store_true")
+    parser.add_argument("--report-certs", help="Report the expiry date and issuer of every https host's certificate", action="store_true")
+    parser.add_argument("--cert-expiry-warning", help="Flag certificates expiring within this many days", type=int, default=30)
+    parser.add_argument("--adaptive-depth", help="Crawl deeper below resources with findings and shallower below barren ones, within --adaptive-min-depth and --adaptive-max-depth. -d still caps the crawl", action="store_true")
+    parser.add_argument("--adaptive-min-depth", help="Depth every part of the site is crawled to with --adaptive-depth", type=int, default=2)
+    parser.add_argument("--adaptive-max-depth", help="Deepest --adaptive-depth goes below findings", type=int, default=6)
+    parser.add_argument("--adaptive-step", help="Levels past a resource with findings that --adaptive-depth crawls", type=int, default=2)
+    parser.add_argument("--path-prefix", help="Only crawl urls whose path starts with this prefix, can be repeated. Seeds are always crawled, links on pages outside the prefixes are never reached", action="append", default=[])
+    parser.add_argument("--allow-redirect-to-external", help="Follow redirects that leave the seed host, the target is scanned but never recursed into", action="store_true")
+    parser.add_argument("--crawl-css", help="Follow stylesheets and the url()/@import references inside them", action="store_true")
+    parser.add_argument("--max-links-per-page", help="Only follow the first N links found on a resource, 0 follows all", type=int, default=5000)
+    parser.add_argument("--follow-pagination", help="Follow rel=next and \"next page\" links to the end of a listing without spending --depth on them", action="store_true")
+    parser.add_argument("--max-pages-per-list", help="Most pages followed along one pagination chain", type=int, default=20)
+    parser.add_argument("--extract-inline", help="Scan the inline <script> and <style> blocks and HTML comments of pages as resources of their own", action="store_true")
+    parser.add_argument("--scan-attributes", help="Also scan every attribute value of every element on a page (data-*, meta content, integrity, onclick...) with character references decoded, listing the element and attribute of each match", action="store_true")
+    parser.add_argument("--dedupe-inline", help="Scan and list identical inline blocks once, with the pages they were found on", action=argparse.BooleanOptionalAction, default=True)
+    parser.add_argument("--crawl-scripts", help="Fetch and scan the scripts pages load with <script src>", action="store_true")
+    parser.add_argument("--js-links", help="Also crawl url-like strings found in inline and crawled scripts, listed as js-link resources since they are only a guess. Urls on other hosts than the script's and the seeds' are only followed when they are in --scope", action="store_true")
+    parser.add_argument("--scope", help="Domain that is part of the assessment, can be repeated, *.example.com style wildcards work. --js-links only follows urls on the host of the script, the seed hosts and these. --exclude-domains takes precedence", action="append", default=[])
+    parser.add_argument("--scope-file", help="File with one --scope domain per line")
+    parser.add_argument("--max-js-links", help="Most --js-links candidates taken from one resource", type=int, default=50)
+    parser.add_argument("--follow-source-maps", help="Fetch the source maps of scripts and scan the original sources embedded in them", action="store_true")
+    parser.add_argument("--max-match-len", help="Longest expected match, sizes the overlap kept between body chunks", type=int, default=4096)
+    parser.add_argument("--dedupe-matches", help="List every distinct match once per resource type, on the first resource it was found on, with how many resources had it", action="store_true")
+    parser.add_argument("--dedupe-across-types", help="Like --dedupe-matches but a match is listed once whatever the type of the resources it was found in, with the set of types", action="store_true")
+    parser.add_argument("--noisy-threshold", help="Warn about patterns matching more often than this in the summary, 0 disables", type=int, default=1000)
+    parser.add_argument("--drop-matches-over", help="Drop matches longer than this many characters, 0 keeps everything", type=int, default=1000, metavar="CHARS")
+    parser.add_argument("--truncate-long-matches", help="Cut matches over --drop-matches-over characters short with a marker instead of dropping them", action="store_true")
+    parser.add_argument("--single-page", help="Only scan the given pages and the scripts, stylesheets and assets they reference, nothing is followed past them whatever --depth is", action="store_true")
+    parser.add_argument("--redact-output-content", help="Mask matches inside the text shown around them by --match-context-html, so reports can be shared, the listed match itself is kept", action="store_true")
+    parser.add_argument("--redact-reveal", help="How many leading characters of a masked match --redact-output-content keeps, at most half of it", type=int, default=4)
+    parser.add_argument("--stream", help="Scan bodies while they download and only keep the ones links are extracted from, can't be combined with --match-context-html, --context or --confidence", action="store_true")
+    parser.add_argument("--scan-documents", help="Extract and scan the text of PDF, Office and OpenDocument files", action="store_true")
+    parser.add_argument("--max-document-size", help="Documents over this many bytes aren't extracted, only their first bytes are scanned raw", type=int, default=20 * 1024 * 1024)
+    parser.add_argument("--collapse-login-redirects", help="Only scan the login page urls redirect to once and count the urls behind it in the summary, on by default", action=argparse.BooleanOptionalAction, default=True)
+    parser.add_argument("--login-redirect-threshold", help="A page this many urls redirect to is taken to be a login page even if its path doesn't say so", type=int, default=3)
+    parser.add_argument("--interactive-on-match", help="Stop at every resource with matches and ask whether to carry on, skip the links found on it or quit crawling. Only used when stdin is a terminal", action="store_true")
+    parser.add_argument("--retry-truncated", help="Fetch a resource again up to this many times when its body ended before its Content-Length", type=int, default=0)
+    parser.add_argument("--script-depth", help="How many scripts, source maps and stylesheets may be followed one from another after a page, apart from --depth", type=int, default=2)
+    parser.add_argument("--no-html-parse", help="Only scan the bodies of the urls given, without parsing them as HTML or following any link. Pages served with a Content-Type other than HTML are never parsed", action="store_true")
+    parser.add_argument("--max-same-url-params", help="Crawl at most this many distinct values of each query parameter on the same path, e.g. of ?color= on faceted listings, 0 disables the limit", type=int, default=0)
+    parser.add_argument("--exclude-domains", help="Neither fetch nor follow links to this domain or its subdomains, *.example.com style wildcards work. Seeds are still crawled", action="append", default=[])
+    parser.add_argument("--exclude-common-thirdparty", help="Exclude common ad, analytics, tracking, social and font domains: %s" % ", ".join(COMMON_THIRD_PARTY_DOMAINS), action="store_true")
+    parser.add_argument("--send-referer", help="Send the url of the page a link was found on as Referer, like a browser following it", action="store_true")
+    parser.add_argument("--seed-referer", help="Referer sent for the seed urls with --send-referer, none by default")
+    parser.add_argument("--exclude-content-type", help="Don't download or scan responses of this content type, image/* style wildcards work. Images, audio, video and fonts are always skipped unless --scan-all-content-types is given", action="append", default=[])
+    parser.add_argument("--scan-all-content-types", help="Also scan images, audio, video and fonts", action="store_true")
+    parser.add_argument("--head-first", help="Send a HEAD request before every download so excluded content types are skipped without fetching them", action="store_true")
+    parser.add_argument("--scan-archives", help="Scan the text files inside zip, jar, tar and gzip downloads, each listed as the archive url followed by !/ and its path", action="store_true")
+    parser.add_argument("--max-archive-size", help="Archives over this many bytes aren't read, and no more than this is extracted from one", type=int, default=20 * 1024 * 1024)
+    parser.add_argument("--max-archive-entries", help="Stop reading an archive after this many text entries", type=int, default=1000)
+    parser.add_argument("--max-body-size", help="Only keep the first N bytes of a body for link extraction, 0 keeps everything", type=int, default=0)
+    parser.add_argument("--connect-timeout", help="Seconds to wait for a connection before giving up on a host (default: 10)", type=float, default=10.0)
+    parser.add_argument("--timeout", help="Seconds a whole request may take, including the download (default: 30)", type=float, default=30.0)
+    parser.add_argument("--range", help="Only fetch part of every resource with a Range request, prefix:BYTES or suffix:BYTES", type=parse_range)
+    parser.add_argument("--prefetch-dns", help="Resolve the hosts of found links in the background before they are crawled, speeds up crawls across many hosts", action="store_true")
+    parser.add_argument("--prefetch-dns-workers", help="How many lookups --prefetch-dns runs at once", type=int, default=8)
+    parser.add_argument("--proxy", help="Send every request through this proxy, http://, https://, socks5:// or socks5h:// with optional user:password@ credentials", type=parse_proxy)
+    parser.add_argument("--resolve", help="Connect to ADDRESS for HOST:PORT instead of resolving it, the hostname is still used for SNI and the Host header, can be repeated", type=parse_resolve, action="append", default=[])
+    parser.add_argument("--session-state", help="Storage state JSON exported from a logged in browser session, its cookies are used for every request. With --login-then-crawl the state of the login is saved there")
+    parser.add_argument("--login-then-crawl", help="Open a browser on this login url, wait for the login to succeed and crawl with its cookies. Needs Playwright", metavar="URL")
+    parser.add_argument("--login-success-url", help="Regex the browser url matches once logged in, for --login-then-crawl")
+    parser.add_argument("--login-success-selector", help="CSS selector of an element only shown once logged in, for --login-then-crawl")
+    parser.add_argument("--login-timeout", help="Seconds --login-then-crawl waits for the login to succeed", type=float, default=300.0)
+    parser.add_argument("--respect-robots", help="Skip urls disallowed by robots.txt and wait its Crawl-delay between requests to a host", action="store_true")
+    parser.add_argument("--crawl-delay", help="Seconds between requests to the same host, overrides the robots.txt Crawl-delay", type=float)
+    parser.add_argument("--ignore-crawl-delay", help="Don't wait the robots.txt Crawl-delay with --respect-robots", action="store_true")
+    parser.add_argument("--throttle-on-match", help="Slow the crawl down to one request per --throttle-delay for a while after every match", action="store_true")
+    parser.add_argument("--throttle-delay", help="Seconds between requests while throttled", type=float, default=2.0)
+    parser.add_argument("--throttle-cooldown", help="Seconds the crawl stays throttled after the last match", type=float, default=60.0)
+    parser.add_argument("-X", "--method", help="HTTP method used to request the seed urls", type=str.upper, default="GET")
+    parser.add_argument("--data", help="Request body sent to the seed urls")
+    parser.add_argument("--data-file", help="File holding the request body sent to the seed urls")
+    parser.add_argument("--user-agent", help="User agent to rotate through, can be repeated", action="append", default=[])
+    parser.add_argument("--accept-language", help="Accept-Language header sent with every request, e.g. 'fr-FR,fr;q=0.9'")
+    parser.add_argument("--locales", help="Comma separated languages to crawl the seeds in one after the other, e.g. en,fr,de, as the Accept-Language instead of --accept-language. Pages are kept apart per language so findings are reported per locale", type=lambda value: [locale.strip() for locale in value.split(",") if locale.strip()])
+    parser.add_argument("--user-agent-file", help="File with one user agent per line to rotate through")
+    parser.add_argument("--rotate-user-agent", help="Pick the next user agent for every request or once per host", choices=["request", "host"], default="request")
+    parser.add_argument("--extract-words", help="Write every distinct word in the fetched content to this file, most frequent first")
+    parser.add_argument("--word-min-length", help="Shortest word --extract-words keeps", type=int, default=4)
+    parser.add_argument("--word-max-length", help="Longest word --extract-words keeps", type=int, default=32)
+    parser.add_argument("--word-alphabet", help="Regex character class words are made of", default="[A-Za-z0-9_]")
+    parser.add_argument("--manifest", help="Write every fetched url with its status, length and SHA-256, the patterns and the options of the run to this JSON file")
+    parser.add_argument("--db", help="SQLite database the run, its resources and matches are added to, created if missing")
+    parser.add_argument("--scan-workers", help="Scan bodies in this many separate processes so CPU heavy patterns don't hold up fetching. Around the number of CPU cores (%d here) is a good start, 0 scans in the fetching worker. Fetching waits once %d bodies per process are queued. Streamed bodies are always scanned as they download" % (os.cpu_count() or 1, SCAN_QUEUE_PER_WORKER), type=int, default=0)
+    parser.add_argument("--fetch-workers", help="Requests in flight at once, 0 leaves it to valradar's -c. With --scan-workers, -c can be raised above it so workers parse pages while this many download", type=int, default=0)
+    parser.add_argument("--max-memory", help="Soft limit in MB, close to it the content of finished resources is moved to a temporary file and read back only for match context and --extract-words, which get slower", type=int, default=0)
+    parser.add_argument("--frontier", help="Where pending and visited urls are tracked, disk keeps memory flat on huge sites at the cost of slower lookups", choices=["memory", "disk"], default="memory")
+    parser.add_argument("--frontier-file", help="SQLite database used by --frontier disk, a temporary one is used and removed by default. It is emptied when the crawl starts")
+    parser.add_argument("--frontier-resume", help="Carry on from the --frontier-file of an interrupted crawl, its visited urls are skipped and its pending ones crawled", action="store_true")
+    parser.add_argument("--state-file", help="Periodically save crawl progress to this file and resume from it when it already exists")
+    parser.add_argument("--store-content", help="Keep the content of every resource in --state-file so the crawl can be scanned again with --replay", action="store_true")
+    parser.add_argument("--replay", help="Scan the content stored in this state file with the given patterns instead of crawling, nothing is requested")
+    parser.add_argument("--since", help="Only scan resources whose Last-Modified is after this, a duration back from now (90m, 12h, 7d, 2w) or an ISO date", type=parse_since)
+    parser.add_argument("--since-missing", help="Whether --since scans resources without a Last-Modified header", choices=["include", "exclude"], default="include")
+    parser.add_argument("--since-no-recurse", help="Don't follow the links of resources older than --since either", action="store_true")
+    parser.add_argument("--content-diff", help="State file of an earlier crawl, urls whose content changed, appeared or disappeared since are listed in the summary. Needs --state-file to be compared next time")
+    parser.add_argument("--diff-states", help="List the urls whose content differs between two state files instead of crawling", nargs=2, metavar=("BEFORE", "AFTER"))
+    parser.add_argument("--revalidate", help="Crawl the resources finished in --state-file again, skipping the download of the ones their server says are unchanged (304) and reusing their findings", action="store_true")
+    parser.add_argument("--flush-interval", help="Seconds between state file flushes", type=float, default=30.0)
+    parser.add_argument("--flush-every", help="Also flush the state file after this many resources, 0 disables", type=int, default=100)
+    parser.add_argument("--compress-state", help="Gzip the state file, uncompressed state files are still read", action=argparse.BooleanOptionalAction, default=True)
+    parser.add_argument("--tls-fingerprint", help="Order TLS cipher suites like the given browser instead of the python default", choices=["default"] + list(TLS_FINGERPRINTS.keys()), default="default")
+    parser.add_argument("--tls-ciphers", help="Custom OpenSSL cipher string, overrides --tls-fingerprint")
+    return parser
+
+def validate_options(parser, args):
+    args.pattern_context = {}
+    if args.patterns_file:
+        try:
+            patterns = load_patterns_file(args.patterns_file)
+        except (OSError, ValueError) as e:
+            parser.error(str(e))
+        args.type = args.type + [value for value, _ in patterns]
+        args.pattern_context = {parse_type(value, 0)[0]: context for value, context in patterns if context is not None}
+    if args.context < 0:
+        parser.error("--context can't be negative")
+    if args.proxy and args.proxy.startswith("socks") and importlib.util.find_spec("socks") is None:
+        parser.error("SOCKS proxies need PySocks, install it with pip install requests[socks]")
+    if args.url is None and not args.replay and not args.diff_states:
+        parser.error("the url is required unless --replay or --diff-states is used")
+    if args.data is not None and args.data_file:
+        parser.error("--data and --data-file can't be used together")
+    if args.stream and (args.match_context_html or args.context or args.pattern_context or args.confidence or args.min_confidence > 0):
+        # They look at the text around matches, which a streamed body doesn't keep
+        parser.error("--stream can't be combined with --match-context-html, --context, a context in --patterns-file, --confidence or --min-confidence")
+    if len(args.type) == 0 and len(args.contains) == 0 and not args.discover and not args.diff_states:
+        parser.error("at least one -t/--type, --contains or --patterns-file pattern is required unless --discover is used")
+    if args.locales is not None and not args.locales:
+        parser.error("--locales needs at least one language")
+    if args.locales and (args.state_file or args.replay or args.frontier_resume):
+        parser.error("--locales can't be combined with --state-file, --replay or --frontier-resume, their records are kept per url")
+    if args.frontier_resume and (args.frontier != "disk" or not args.frontier_file):
+        parser.error("--frontier-resume needs --frontier disk and the --frontier-file to resume from")
+    if args.scan_workers < 0 or args.fetch_workers < 0:
+        parser.error("--scan-workers and --fetch-workers can't be negative")
+    if args.script_depth < 1:
+        parser.error("--script-depth must be at least 1")
+    if args.login_redirect_threshold < 2:
+        parser.error("--login-redirect-threshold must be at least 2")
+    if args.prefetch_dns_workers < 1:
+        parser.error("--prefetch-dns-workers must be at least 1")
+    if args.redact_reveal < 0:
+        parser.error("--redact-reveal can't be negative")
+    if args.max_memory > 0 and resident_memory() is None:
+        parser.error("--max-memory can't measure the memory used on this platform")
+    if args.normalize_whitespace and (args.stream or args.max_body_size > 0):
+        parser.error("--normalize-whitespace scans whole bodies, it can't be combined with --stream or --max-body-size")
+    if args.login_then_crawl and not (args.login_success_url or args.login_success_selector):
+        parser.error("--login-then-crawl needs --login-success-url or --login-success-selector to know when the login succeeded")
+    if (args.login_success_url or args.login_success_selector) and not args.login_then_crawl:
+        parser.error("--login-success-url and --login-success-selector only apply to --login-then-crawl")
+
+def pattern_terms(args):
+    """Every -t pattern and --contains literal with the index unnamed ones are labelled by"""
+    terms = [(value, False) for value in args.type] + [(value, True) for value in args.contains]
+    return [(index, value, literal) for index, (value, literal) in enumerate(terms, start=1)]
+
+def compile_type(value, index, options, literal=False):
+    name, pattern = parse_type(value, index)
+    if literal:
+        pattern = re.escape(pattern)
+    if options.whole_word or options.anchor:
+        pattern = wrap_pattern(pattern, options.whole_word, options.anchor)
+    return name, re.compile(pattern)
+
+def _VALRADAR_INIT(args):
+    parser = build_parser()
     args = parser.parse_args(args)
-    types_dict = { a.split("=")[0]:a.split("=")[1] for a in args.type }
-    return [DataContext(args.url, types_dict)]
+    validate_options(parser, args)
+    if args.probe_wordlist:
+        args.probe_common_paths = True
+    if args.single_page:
+        args.crawl_scripts = args.crawl_css = True
+    if args.interactive_on_match and (args.url == "-" or not sys.stdin.isatty()):
+        debug("--interactive-on-match is ignored, stdin is not a terminal")
+        args.interactive_on_match = False
+    args.excluded_content_types = [value.lower() for value in args.exclude_content_type]
+    if not args.scan_all_content_types:
+        args.excluded_content_types += DEFAULT_EXCLUDED_CONTENT_TYPES
+    # valradar --output-dir collects the artifacts of a run in one place
+    output_dir = os.environ.get("VALRADAR_OUTPUT_DIR")
+    if output_dir and not args.manifest:
+        args.manifest = os.path.join(output_dir, "manifest.json")
+    args.body = args.data.encode() if args.data is not None else None
+    if args.data_file:
+        with open(args.data_file, "rb") as f:
+            args.body = f.read()
+    # Discovery skips the regex phase entirely
+    types_dict = {}
+    if not args.discover:
+        for index, value, literal in pattern_terms(args):
+            name, pattern = compile_type(value, index, args, literal)
+            types_dict[name] = pattern
+    if args.diff_states:
+        try:
+            return diff_states(*args.diff_states, args)
+        except (OSError, ValueError, KeyError) as e:
+            parser.error("can't compare state files: %s" % e)
+    if args.replay:
+        try:
+            return replay(stored_records(args.replay), types_dict, args)
+        except (OSError, ValueError) as e:
+            parser.error(str(e))
+    seeds = read_urls(sys.stdin) if args.url == "-" else [args.url]
+    if args.expand:
+        templates, seeds = seeds, []
+        for template in templates:
+            seeds.extend(url for url in expand_url(template, max(0, args.max_expanded - len(seeds))) if url not in seeds)
+        debug("Expanded %d seed templates into %d urls" % (len(templates), len(seeds)))
+    if not seeds:
+        parser.error("no urls were given on stdin")
+    # file:// urls and existing paths are scanned from disk
+    local = [is_local(seed) for seed in seeds]
+    if any(local) and not all(local):
+        parser.error("local paths and urls can't be scanned together")
+    if all(local):
+        if args.locales:
+            parser.error("--locales only applies to urls")
+        if args.login_then_crawl:
+            parser.error("--login-then-crawl only applies to urls")
+        seeds = [local_path(seed) for seed in seeds]
+    state = CrawlState()
+    if args.proxy:
+        state.session.proxies.update({"http": args.proxy, "https": args.proxy})
+    addresses = {}
+    resolve = resolver(dict(args.resolve or []), addresses) if args.resolve or args.prefetch_dns else None
+    ciphers = args.tls_ciphers or TLS_FINGERPRINTS.get(args.tls_fingerprint)
+    if ciphers:
+        state.session.mount("https://", CipherAdapter(ciphers, resolve=resolve))
+    elif resolve:
+        state.session.mount("https://", ResolveAdapter(resolve))
+    if resolve:
+        state.session.mount("http://", ResolveAdapter(resolve))
+    if args.login_then_crawl:
+        try:
+            set_session_cookies(state.session, browser_login(args))
+        except ValueError as e:
+            parser.error(str(e))
+    elif args.session_state:
+        load_session_state(state.session, args.session_state)
+    state.max_memory = args.max_memory * 1024 * 1024
+    state.whitespace = args.normalize_whitespace
+    if args.scan_workers > 0 and types_dict:
+        try:
+            state.start_scan_workers(args.scan_workers)
+        except ValueError as e:
+            parser.error(str(e))
+    if args.fetch_workers > 0:
+        state.fetch_slots = threading.BoundedSemaphore(args.fetch_workers)
+    if args.prefetch_dns:
+        state.dns_cache = addresses
+        state.dns_pool = ThreadPoolExecutor(max_workers=args.prefetch_dns_workers)
+        state.prefetch_dns(seeds)
+    state.frontier = DiskFrontier(args.frontier_file, args.frontier_resume) if args.frontier == "disk" else MemoryFrontier()
+    state.seeds = seeds
+    if args.expand:
+        state.stats["expanded"] = len(seeds)
+    state.scope_hosts.update(urlsplit(seed).hostname for seed in seeds)
+    state.user_agents = args.user_agent + (load_lines(args.user_agent_file) if args.user_agent_file else [])
+    state.rotate_per_host = args.rotate_user_agent == "host"
+    state.probe_paths = load_lines(args.probe_wordlist) if args.probe_wordlist else COMMON_PATHS
+    state.flush_interval = args.flush_interval
+    state.flush_every = args.flush_every
+    state.compress_state = args.compress_state
+    state.store_content = args.store_content
+    state.interactive = args.interactive_on_match
+    state.excluded_domains = [domain.lower().strip(".") for domain in args.exclude_domains]
+    state.scope_domains = [domain.lower().strip(".") for domain in args.scope + (load_lines(args.scope_file) if args.scope_file else [])]
+    if args.exclude_common_thirdparty:
+        state.excluded_domains += COMMON_THIRD_PARTY_DOMAINS
+    if args.state_file:
+        state.state_file = args.state_file
+        if os.path.exists(args.state_file):
+            return resume(state.load(), types_dict, args, state)
+    if args.frontier_resume:
+        pending = [DataContext(url, types_dict, args, state, resource_type, depth) for url, resource_type, depth in state.frontier.pending_urls() if url not in seeds]
+        return [DataContext(seed, types_dict, args, state, "file" if all(local) else "page") for seed in seeds] + pending
+    if args.locales:
+        # Every seed is crawled once per locale, each crawl keeping its own pages
+        return [DataContext(seed, types_dict, args, state, "page", 0, locale) for locale in args.locales for seed in seeds]
+    return [DataContext(seed, types_dict, args, state, "file" if all(local) else "page") for seed in seeds]
+
+EXPANSION = re.compile(r"\{([^{}]*)\}")
+
+def expansion_values(spec):
+    numeric = re.fullmatch(r"(\d+)-(\d+)", spec)
+    if numeric:
+        start, end = numeric.groups()
+        # {001-100} keeps the zero padding of its start
+        width = len(start) if start.startswith("0") and len(start) > 1 else 0
+        step = 1 if int(end) >= int(start) else -1
+        return [str(n).zfill(width) for n in range(int(start), int(end) + step, step)]
+    if "," in spec:
+        return spec.split(",")
+    return ["{%s}" % spec]
+
+def expand_url(template, limit):
+    # Every combination of the {start-end} and {a,b,c} parts, capped at limit urls
+    parts = EXPANSION.split(template)
+    literals, specs = parts[0::2], parts[1::2]
+    urls = []
+    for values in itertools.islice(itertools.product(*(expansion_values(spec) for spec in specs)), limit):
+        urls.append("".join(itertools.chain.from_iterable(itertools.zip_longest(literals, values, fillvalue=""))))
+    return urls
+
+def normalize_url(url):
+    """Canonical form of a url, so the same resource isn't crawled twice
+
+    The scheme and host are lowercased, an empty path becomes / and the fragment is
+    dropped. Query parameters are sorted by name, repeated ones keep their relative
+    order and their encoding is left untouched.
+    """
+    parts = urlsplit(url)
+    query = "&".join(sorted((p for p in parts.query.split("&") if p), key=lambda p: p.split("=", 1)[0]))
+    return urlunsplit((parts.scheme.lower(), parts.netloc.lower(), parts.path or "/", query, ""))
+
+def is_local(seed):
+    return seed.startswith("file://") or (not seed.startswith(("http://", "https://")) and os.path.exists(seed))
+
+def local_path(seed):
+    path = unquote(urlsplit(seed).path) if seed.startswith("file://") else seed
+    return os.path.abspath(path)
+
+def read_urls(lines):
+    # Blank lines and duplicates are dropped, the input order is kept
+    urls = []
+    for line in lines:
+        url = line.strip()
+        if url and url not in urls:
+            urls.append(url)
+    return urls
+
+def resume(saved, types, options, state):
+    # Finished resources come back with their results and are never fetched again,
+    # the crawl carries on from the resources that were still pending. With --revalidate
+    # finished resources are requested again, conditionally on their ETag and Last-Modified,
+    # except inline blocks which have neither and come back as they were.
+    revalidated = set()
+    if options.revalidate:
+        revalidated = {url for url, record in saved["records"].items() if record["type"] != "inline"}
+    for url in saved["processed"]:
+        if url not in revalidated:
+            state.frontier.pop(url)
+    contexts = []
+    for url, record in saved["records"].items():
+        context = DataContext(url, types, options, state, record["type"], record["depth"])
+        if url in revalidated:
+            context.cached = record
+            contexts.append(context)
+            continue
+        context.data['status'] = record["status"]
+        context.types_result = {k: [Match(*m) for m in v] for k, v in record["matches"].items()}
+        state.records[url] = record
+        contexts.append(context)
+
+    for url, resource_type, depth in saved["pending"]:
+        contexts.append(DataContext(url, types, options, state, resource_type, depth))
+
+    return contexts
+
+def content_changes(before, after):
+    """(url, change, hash before, hash after) for every url added, removed or changed between two sets of state file records
+
+    Resources recorded without a hash, by older state files or because they failed, can't be compared.
+    """
+    changes = []
+    for url, record in after.items():
+        if url not in before:
+            changes.append((url, "added", None, record.get("sha256")))
+        elif before[url].get("sha256") and record.get("sha256") and before[url]["sha256"] != record["sha256"]:
+            changes.append((url, "changed", before[url]["sha256"], record["sha256"]))
+    changes.extend((url, "removed", record.get("sha256"), None) for url, record in before.items() if url not in after)
+    return changes
+
+def content_change_summary(changes):
+    summary = {"content %s" % change: sum(1 for c in changes if c[1] == change) for change in ("changed", "added", "removed")}
+    for url, change, before, after in changes:
+        summary["%s %s" % (change, url)] = "%s -> %s" % ((before or "-")[:12], (after or "-")[:12])
+    return summary
+
+class ContentChange:
+    """A url whose content differs between the two state files given to --diff-states"""
+
+    def __init__(self, url, change, before, after, options):
+        self.url = url
+        self.change = change
+        self.before = before
+        self.after = after
+        self.options = options
+
+    def __repr__(self):
+        return "<ContentChange %s %s>" % (self.change, self.url)
+
+    def collect(self):
+        return []
+
+    def process(self):
+        return {"url": self.url, "change": self.change, "before": self.before or "", "after": self.after or ""}
+
+def diff_states(before, after, options):
+    changes = content_changes(read_state(before)["records"], read_state(after)["records"])
+    return [ContentChange(*change, options) for change in changes]
+
+def replay(records, types, options):
+    # The stored resources are scanned as they were captured, marked visited so collecting them does nothing
+    state = CrawlState()
+    state.whitespace = options.normalize_whitespace
+    state.seeds = [url for url, record in records.items() if record["depth"] == 0]
+    contexts = []
+    for url, record in records.items():
+        context = DataContext(url, types, options, state, record["type"], record["depth"])
+        state.frontier.pop(url)
+        context.data['status'] = record["status"]
+        context.data['content'] = record["content"]
+        context.data['hash'] = hashlib.sha256(record["content"].encode()).hexdigest()
+        if types:
+            context.types_result = state.scan(context.data['hash'], record["content"], types)
+        context.limit_match_length()
+        context.score_matches()
+        contexts.append(context)
+    return contexts
+
+def _VALRADAR_CHECK(args):
+    # Validates what init would, without reading stdin or touching the network
+    parser = build_parser()
+
+    def fail(message):
+        raise ValueError(message)
+    parser.error = fail
+
+    try:
+        args = parser.parse_args(args)
+        validate_options(parser, args)
+    except ValueError as e:
+        return [{"check": "arguments", "valid": False, "detail": str(e)}]
+    results = [{"check": "arguments", "valid": True, "detail": ""}]
+
+    for index, value, literal in pattern_terms(args):
+        name = parse_type(value, index)[0]
+        try:
+            compile_type(value, index, args, literal)
+            results.append({"check": "pattern %s" % name, "valid": True, "detail": ""})
+        except re.error as e:
+            results.append({"check": "pattern %s" % name, "valid": False, "detail": str(e)})
+
+    try:
+        re.compile(args.word_alphabet)
+        results.append({"check": "word alphabet", "valid": True, "detail": ""})
+    except re.error as e:
+        results.append({"check": "word alphabet", "valid": False, "detail": str(e)})
+
+    files = [
+        # --login-then-crawl writes it rather than reading it
+        ("session state", None if args.login_then_crawl else args.session_state, lambda path: load_session_state(requests.Session(), path)),
+        ("data file", args.data_file, lambda path: open(path, "rb").close()),
+        ("user agent file", args.user_agent_file, load_lines),
+        ("probe wordlist", args.probe_wordlist, load_lines),
+        ("scope file", args.scope_file, load_lines),
+    ]
+    for label, path, load in files:
+        if not path:
+            continue
+        try:
+            load(path)
+            results.append({"check": "%s %s" % (label, path), "valid": True, "detail": ""})
+        except (OSError, ValueError, KeyError) as e:
+            results.append({"check": "%s %s" % (label, path), "valid": False, "detail": str(e)})
+
+    if args.replay:
+        try:
+            stored_records(args.replay)
+            results.append({"check": "replay %s" % args.replay, "valid": True, "detail": ""})
+        except (OSError, ValueError) as e:
+            results.append({"check": "replay %s" % args.replay, "valid": False, "detail": str(e)})
+    elif args.url != "-":
+        seeds = expand_url(args.url, args.max_expanded) if args.expand else [args.url]
+        for seed in seeds:
+            parts = urlsplit(seed)
+            valid = parts.scheme in ("http", "https") and bool(parts.netloc)
+            results.append({"check": "url %s" % seed, "valid": valid, "detail": "" if valid else "not an http(s) url"})
+
+    return results
 
 def _VALRADAR_COLLECT_DATA(context):
-    return context.collect()
+    try:
+        return context.collect()
+    except Exception as e:
+        # Still reported by valradar, the context only remembers it failed
+        context.error = e
+        raise
 
 def _VALRADAR_PROCESS_DATA(context):
     return context.process()
 
+def certificate_summary(state, warning_days):
+    summary = {}
+    for host in sorted(state.certificates.keys()):
+        certificate = state.certificates[host]
+        if not certificate:
+            # Nothing is returned for certificates that weren't verified
+            summary["cert %s" % host] = "unverified, no details available"
+            continue
+
+        issuer = dict(field for rdn in certificate.get("issuer", ()) for field in rdn)
+        expires = ssl.cert_time_to_seconds(certificate["notAfter"])
+        days = int((expires - time.time()) // 86400)
+        line = "expires %s (%d days) issued by %s" % (
+            time.strftime("%Y-%m-%d", time.gmtime(expires)),
+            days,
+            issuer.get("organizationName") or issuer.get("commonName", "unknown"),
+        )
+        if days < 0:
+            line += " EXPIRED"
+        elif days <= warning_days:
+            line += " EXPIRING"
+        summary["cert %s" % host] = line
+    return summary
+
+DB_SCHEMA = """
+CREATE TABLE IF NOT EXISTS runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    started TEXT NOT NULL,
+    finished TEXT NOT NULL,
+    seeds TEXT NOT NULL,
+    config_hash TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS resources (
+    run_id INTEGER NOT NULL REFERENCES runs(id),
+    url TEXT NOT NULL,
+    type TEXT NOT NULL,
+    depth INTEGER NOT NULL,
+    status TEXT
+);
+CREATE TABLE IF NOT EXISTS matches (
+    run_id INTEGER NOT NULL REFERENCES runs(id),
+    url TEXT NOT NULL,
+    pattern TEXT NOT NULL,
+    value TEXT NOT NULL,
+    line INTEGER NOT NULL,
+    column INTEGER NOT NULL
+);
+"""
+
+def iso_time(timestamp):
+    return time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(timestamp))
+
+def save_to_db(path, contexts, state):
+    options = contexts[0].options
+    # Runs with the same options share a config hash, the seed is part of them
+    config = json.dumps({k: v for k, v in vars(options).items() if k != "body"}, sort_keys=True, default=str)
+
+    connection = sqlite3.connect(path)
+    try:
+        with connection:
+            connection.executescript(DB_SCHEMA)
+            run_id = connection.execute(
+                "INSERT INTO runs (started, finished, seeds, config_hash) VALUES (?, ?, ?, ?)",
+                (iso_time(state.started), iso_time(time.time()), " ".join(state.seeds), hashlib.sha256(config.encode()).hexdigest()),
+            ).lastrowid
+            connection.executemany(
+                "INSERT INTO resources (run_id, url, type, depth, status) VALUES (?, ?, ?, ?, ?)",
+                [(run_id, c.url, c.resource_type, c.depth, None if c.data.get('status') is None else str(c.data['status'])) for c in contexts],
+            )
+            connection.executemany(
+                "INSERT INTO matches (run_id, url, pattern, value, line, column) VALUES (?, ?, ?, ?, ?, ?)",
+                [(run_id, c.url, k, m.value, m.line, m.column) for c in contexts for k, matches in c.types_result.items() for m in matches],
+            )
+    finally:
+        connection.close()
+
+def write_manifest(path, contexts, state):
+    """Record exactly what a crawl retrieved and with which settings
+
+    Keys are sorted so the same crawl always serializes to the same bytes,
+    which lets the file be signed or hashed as evidence.
+    """
+    options = contexts[0].options
+    metadata = VALRADAR_CONFIG["metadata"]
+    resources = []
+    for c in contexts:
+        # Only resources whose body was actually downloaded or decoded have a hash
+        if 'sha256' not in c.data:
+            continue
+        resources.append({
+            "url": c.url,
+            "type": c.resource_type,
+            "status": c.data.get('status'),
+            "length": c.data['length'],
+            "sha256": c.data['sha256'],
+            "fetched at": c.data.get('request', {}).get("fetched at"),
+        })
+
+    manifest = {
+        "tool": {"plugin": "web.regex", "name": metadata["name"], "version": metadata["version"]},
+        "started": iso_time(state.started),
+        "finished": iso_time(time.time()),
+        "seeds": state.seeds,
+        "patterns": {name: pattern.pattern for name, pattern in contexts[0].types.items()},
+        "config": {k: v for k, v in vars(options).items() if k != "body"},
+        "resources": sorted(resources, key=lambda resource: resource["url"]),
+    }
+    with open(path, "w") as f:
+        json.dump(manifest, f, indent=2, sort_keys=True, default=str)
+    return len(resources)
+
+def external_domains_summary(state):
+    summary = {}
+    # Most referenced first, ties by name
+    for host, count in sorted(state.external_links.items(), key=lambda item: (-item[1], item[0])):
+        contacted = "contacted" if host in state.external_contacted else "linked only"
+        summary["external %s" % host] = "%d references, %s" % (count, contacted)
+    return summary
+
+def pattern_summary(contexts, threshold):
+    counts = Counter()
+    for context in contexts:
+        for k, matches in context.types_result.items():
+            counts[k] += len(matches)
+
+    summary = {}
+    for k in contexts[0].types.keys():
+        summary["matches %s" % k] = str(counts[k])
+        if threshold > 0 and counts[k] > threshold:
+            summary["matches %s" % k] += " (over --noisy-threshold %d, the pattern may be too loose)" % threshold
+    return summary
+
+def extract_words(contexts, options):
+    token = re.compile("%s{%d,%d}" % (options.word_alphabet, options.word_min_length, options.word_max_length))
+    counts = Counter()
+    for context in contexts:
+        content = context.content()
+        if not content:
+            continue
+        # Markup would flood the list with tag and attribute names
+        if context.resource_type in PAGE_TYPES:
+            content = MARKUP.sub(" ", content)
+        counts.update(token.findall(content))
+
+    # Most frequent first, ties alphabetically so the file is stable between runs
+    words = sorted(counts.items(), key=lambda item: (-item[1], item[0]))
+    with open(options.extract_words, "w") as f:
+        for word, _ in words:
+            f.write(word + "\n")
+    return len(words)
+
+HOST_SORT_KEYS = {
+    "matches": lambda host, row: (-row["matches"], host),
+    "crawled": lambda host, row: (-row["crawled"], host),
+    "errors": lambda host, row: (-row["errors"], host),
+    "bytes": lambda host, row: (-row["bytes"], host),
+    "host": lambda host, row: host,
+}
+
+def host_summary(contexts, sort):
+    """One row per host with the resources crawled, matches by pattern, errors and bytes downloaded
+
+    Failed requests and error responses (4xx/5xx) both count as errors. Matches in inline
+    blocks and archive entries count for the host of the page or archive they came from.
+    """
+    hosts = {}
+    for context in contexts:
+        host = urlsplit(context.url).hostname
+        if not host:
+            continue
+        row = hosts.setdefault(host, {"crawled": 0, "matches": 0, "patterns": Counter(), "errors": 0, "bytes": 0})
+        status = context.data.get('status')
+        if isinstance(status, int):
+            row["crawled"] += 1
+        if context.error is not None or (isinstance(status, int) and status >= 400):
+            row["errors"] += 1
+        row["bytes"] += context.data.get('length', 0)
+        for k, matches in context.types_result.items():
+            row["matches"] += len(matches)
+            row["patterns"][k] += len(matches)
+
+    summary = {}
+    for host, row in sorted(hosts.items(), key=lambda item: HOST_SORT_KEYS[sort](*item)):
+        patterns = ", ".join("%s %d" % (k, count) for k, count in row["patterns"].most_common() if count)
+        matches = "%d matches (%s)" % (row["matches"], patterns) if patterns else "0 matches"
+        summary["host %s" % host] = "%d crawled, %s, %d errors, %d bytes" % (row["crawled"], matches, row["errors"], row["bytes"])
+    return summary
+
+def coverage_summary(state):
+    summary = {}
+    widest = max(state.discovered.values())
+    for depth in sorted(state.discovered.keys()):
+        fetched = state.fetched[depth]
+        skipped = state.discovered[depth] - fetched
+        bar = "#" * max(1, round(40 * state.discovered[depth] / widest))
+        summary["depth %d" % depth] = "%s %d fetched, %d skipped" % (bar, fetched, skipped)
+    return summary
+
+def _VALRADAR_FINISH(contexts):
+    if len(contexts) == 0:
+        return None
+
+    if contexts[0].options.diff_states:
+        return {"content %s" % change: sum(1 for c in contexts if c.change == change) for change in ("changed", "added", "removed")}
+
+    state = contexts[0].state
+    state.flush()
+    if contexts[0].options.db:
+        save_to_db(contexts[0].options.db, contexts, state)
+    words = extract_words(contexts, contexts[0].options) if contexts[0].options.extract_words else None
+    manifest = write_manifest(contexts[0].options.manifest, contexts, state) if contexts[0].options.manifest else None
+
+    summary = {
+        "resources": state.frontier.visited_count(),
+        "scans": state.stats["scans"],
+        "scans saved by content hash": state.stats["scans_saved"],
+        "off-scope redirects": state.stats["off_scope_redirects"],
+    }
+
+    summary.update(pattern_summary(contexts, contexts[0].options.noisy_threshold))
+
+    # Written above, an interrupted crawl picks up its pending resources from it on the next run
+    if state.state_file is not None:
+        summary["state saved to %s" % state.state_file] = "%d resources done, %d pending" % (state.frontier.visited_count(), len(state.frontier.pending_urls()))
+
+    if words is not None:
+        summary["words written to %s" % contexts[0].options.extract_words] = words
+
+    if manifest is not None:
+        summary["resources in manifest %s" % contexts[0].options.manifest] = manifest
+
+    if contexts[0].options.expand:
+        summary["urls expanded from seeds"] = state.stats["expanded"]
+
+    if state.stats["links_skipped"]:
+        summary["links skipped over --max-links-per-page"] = state.stats["links_skipped"]
+
+    if state.stats["too_long"]:
+        action = "truncated" if contexts[0].options.truncate_long_matches else "dropped"
+        summary["matches %s over --drop-matches-over" % action] = state.stats["too_long"]
+
+    if contexts[0].options.extract_inline:
+        summary["inline blocks scanned"] = state.stats["inline_blocks"]
+        summary["duplicate inline blocks skipped"] = state.stats["inline_duplicates"]
+
+    if contexts[0].options.max_memory:
+        summary["resources spilled to disk"] = state.stats["spilled"]
+
+    if contexts[0].options.revalidate:
+        summary["unchanged since the last crawl (304)"] = state.stats["not_modified"]
+        summary["re-fetched"] = state.stats["refetched"]
+
+    if contexts[0].options.throttle_on_match:
+        summary["throttled requests"] = state.stats["throttled"]
+
+    if contexts[0].options.since is not None:
+        summary["older than --since, not scanned"] = state.stats["older_than_since"]
+
+    if contexts[0].options.js_links:
+        summary["links guessed from scripts"] = state.stats["js_links"]
+        summary["links guessed from scripts to hosts out of scope"] = state.stats["js_links_out_of_scope"]
+
+    if contexts[0].options.adaptive_depth:
+        summary["skipped by adaptive depth"] = state.stats["adaptive_skipped"]
+
+    if contexts[0].options.path_prefix:
+        summary["skipped outside path prefix"] = state.stats["outside_path_prefix"]
+
+    if contexts[0].options.follow_pagination:
+        summary["pagination loops stopped"] = state.stats["pagination_loops"]
+
+    if contexts[0].options.coverage:
+        summary.update(coverage_summary(state))
+
+    if contexts[0].options.group_by == "host":
+        summary.update(host_summary(contexts, contexts[0].options.group_sort))
+
+    if contexts[0].options.report_external_domains:
+        summary.update(external_domains_summary(state))
+
+    if contexts[0].options.report_certs:
+        summary.update(certificate_summary(state, contexts[0].options.cert_expiry_warning))
+
+    if contexts[0].options.content_diff:
+        try:
+            summary.update(content_change_summary(content_changes(read_state(contexts[0].options.content_diff)["records"], state.scanned_records())))
+        except (OSError, ValueError, KeyError) as e:
+            summary["content diff"] = "failed to read %s: %s" % (contexts[0].options.content_diff, e)
+
+    if state.stats["script_depth_skipped"]:
+        summary["skipped beyond --script-depth"] = state.stats["script_depth_skipped"]
+
+    if state.stats["attribute_matches"]:
+        summary["matches found in attribute values"] = state.stats["attribute_matches"]
+    if state.stats["not_html"]:
+        summary["pages not parsed as HTML (content type)"] = state.stats["not_html"]
+
+    if contexts[0].options.max_same_url_params > 0:
+        summary["skipped over --max-same-url-params"] = state.stats["param_values_skipped"]
+
+    if state.excluded_domains:
+        summary["skipped on excluded domains"] = state.stats["excluded_domain"]
+
+    truncated = [context for context in contexts if 'truncated' in context.data]
+    if truncated or contexts[0].options.retry_truncated:
+        summary["truncated responses"] = len(truncated)
+        if contexts[0].options.retry_truncated:
+            summary["truncated responses fetched again"] = state.stats["truncated_retries"]
+        for context in truncated:
+            summary["truncated %s" % context.url] = context.data['truncated']
+
+    if contexts[0].options.interactive_on_match:
+        summary["links skipped from the prompt"] = state.stats["skipped_interactively"]
+        summary["stopped from the prompt"] = "yes" if state.stopped else "no"
+
+    for target in sorted(state.login_targets):
+        summary["require authentication (redirected to %s)" % target] = len(state.redirect_sources[target])
+
+    if state.stats["content_type_excluded"]:
+        summary["skipped by content type"] = state.stats["content_type_excluded"]
+
+    if contexts[0].options.scan_archives:
+        summary["archive entries scanned"] = state.stats["archive_entries"]
+        summary["binary archive entries skipped"] = state.stats["archive_binary"]
+        summary["archives cut short by limits"] = state.stats["archive_limited"]
+
+    if contexts[0].options.prefetch_dns:
+        summary["hosts resolved ahead"] = state.stats["dns_prefetched"]
+
+    state.frontier.close()
+    if state.scan_pool is not None:
+        state.scan_pool.shutdown(wait=False, cancel_futures=True)
+    if state.dns_pool is not None:
+        state.dns_pool.shutdown(wait=False, cancel_futures=True)
+    return summary
+
 VALRADAR_CONFIG = {
     "init": _VALRADAR_INIT,
+    "check": _VALRADAR_CHECK,
     "collect_data": _VALRADAR_COLLECT_DATA,
     "process_data": _VALRADAR_PROCESS_DATA,
+    "finish": _VALRADAR_FINISH,
+    # --verbose-findings columns that change every time a finding is seen, watch mode leaves them out when comparing findings
+    "volatile_fields": ["fetched at"],
     "metadata": {
         "name": "Email Scraper",
         "description": "Extract emails from a website",
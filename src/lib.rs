@@ -1,6 +1,8 @@
 pub mod plugin;
 pub mod orchestrator;
+pub mod scanner;
 pub mod utils;
 
-pub use plugin::Plugin;
-pub use orchestrator::Orchestrator; 
\ No newline at end of file
+pub use plugin::{HookTiming, Plugin};
+pub use orchestrator::Orchestrator;
+pub use scanner::{ScanReport, Scanner, ScannerBuilder}; 
\ No newline at end of file
@@ -1,4 +1,5 @@
-use std::sync::{Arc, Mutex};
+use std::sync::{Arc, Mutex, MutexGuard};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
 use std::thread;
 use anyhow::Result;
 use crossbeam::channel;
@@ -6,12 +7,26 @@ use crossbeam::channel;
 use crate::plugin::Plugin;
 use crate::utils;
 
+/// Counters of the collection since the last `init`, readable while `run` is going
+#[derive(Default)]
+pub struct CollectionProgress {
+    /// Contexts handed to `collect_data`, failed ones included
+    pub collected: AtomicUsize,
+    /// Contexts returned by `collect_data`
+    pub discovered: AtomicUsize,
+}
+
 /// The Orchestrator manages multiple worker threads for processing data
 pub struct Orchestrator {
     plugin: Arc<Plugin>,
     num_workers: usize,
     data_queue: Arc<Mutex<Vec<utils::ExecutionContext>>>,
     results: Arc<Mutex<Vec<utils::ExecutionContext>>>,
+    errors: Arc<AtomicUsize>,
+    error_log: Arc<Mutex<Vec<String>>>,
+    max_errors: usize,
+    progress: Arc<CollectionProgress>,
+    stopped: Arc<AtomicBool>,
 }
 
 impl Orchestrator {
@@ -22,11 +37,59 @@ impl Orchestrator {
             num_workers,
             data_queue: Arc::new(Mutex::new(Vec::new())),
             results: Arc::new(Mutex::new(Vec::new())),
+            errors: Arc::new(AtomicUsize::new(0)),
+            error_log: Arc::new(Mutex::new(Vec::new())),
+            max_errors: 0,
+            progress: Arc::new(CollectionProgress::default()),
+            stopped: Arc::new(AtomicBool::new(false)),
         }
     }
 
+    /// Abort collection once more than `max_errors` collection errors happened, 0 disables the limit
+    pub fn set_max_errors(&mut self, max_errors: usize) {
+        self.max_errors = max_errors;
+    }
+
+    /// Number of collection errors since the last `init`
+    pub fn error_count(&self) -> usize {
+        self.errors.load(Ordering::SeqCst)
+    }
+
+    /// Take the collection errors recorded so far, each prefixed with the context that failed
+    pub fn take_errors(&self) -> Vec<String> {
+        let mut error_log = lock(&self.error_log);
+        error_log.drain(..).collect()
+    }
+
+    /// Whether the error count exceeded the configured limit
+    pub fn error_limit_reached(&self) -> bool {
+        error_limit_reached(&self.errors, self.max_errors)
+    }
+
+    /// Counters of the collection, shared with the worker threads
+    pub fn progress(&self) -> Arc<CollectionProgress> {
+        Arc::clone(&self.progress)
+    }
+
+    /// Flag that ends the collection early once set, from any thread, until the next `init`
+    ///
+    /// Items being collected finish, the ones still queued are dropped.
+    pub fn stop_flag(&self) -> Arc<AtomicBool> {
+        Arc::clone(&self.stopped)
+    }
+
+    /// Whether the collection was ended early through the stop flag
+    pub fn stopped(&self) -> bool {
+        self.stopped.load(Ordering::SeqCst)
+    }
+
     /// Initialize the plugin and set up the data queue
     pub fn init(&mut self, args: &[String]) -> Result<()> {
+        self.errors.store(0, Ordering::SeqCst);
+        self.stopped.store(false, Ordering::SeqCst);
+        self.progress.collected.store(0, Ordering::SeqCst);
+        self.progress.discovered.store(0, Ordering::SeqCst);
+        lock(&self.error_log).clear();
         let initial_data = self.plugin.init(args)?;
         utils::debug(&format!("Plugin initialized with {} items", initial_data.len()));
         
@@ -37,10 +100,15 @@ impl Orchestrator {
 
     /// Set the data queue
     pub fn set_data_queue(&mut self, new_data: Vec<utils::ExecutionContext>) {
-        let mut data_queue = self.data_queue.lock().unwrap();
+        let mut data_queue = lock(&self.data_queue);
         *data_queue = new_data;
     }
 
+    /// The data waiting to be collected by the next `run`
+    pub fn queued(&self) -> Vec<utils::ExecutionContext> {
+        lock(&self.data_queue).clone()
+    }
+
     /// Start the worker threads and process all data
     pub fn run(&self) -> Result<Vec<utils::ExecutionContext>> {
         if self.num_workers == 0 {
@@ -55,20 +123,38 @@ impl Orchestrator {
             let plugin = Arc::clone(&self.plugin);
             let rx = rx.clone();
             let results = Arc::clone(&self.results);
+            let errors = Arc::clone(&self.errors);
+            let error_log = Arc::clone(&self.error_log);
+            let progress = Arc::clone(&self.progress);
+            let stopped = Arc::clone(&self.stopped);
+            let max_errors = self.max_errors;
             
             let handle = thread::spawn(move || {
                 utils::debug(&format!("Worker {} started", worker_id));
                 
                 while let Ok(data) = rx.recv() {
-                    utils::debug(&format!("Worker {} processing: {:?}", worker_id, data));
-                    
-                    match plugin.collect_data(&data) {
+                    // Drain the remaining work without collecting once the crawl is aborted
+                    if error_limit_reached(&errors, max_errors) || stopped.load(Ordering::SeqCst) {
+                        continue;
+                    }
+
+                    // Anything going wrong with one item is recorded as its error, the worker keeps going
+                    let collected = utils::recover::catch("collect_data", || {
+                        utils::debug(&format!("Worker {} processing: {:?}", worker_id, data));
+                        plugin.collect_data(&data)
+                    });
+
+                    progress.collected.fetch_add(1, Ordering::SeqCst);
+                    match collected {
                         Ok(result) => {
-                            let mut results = results.lock().unwrap();
-                            results.extend(result);
+                            progress.discovered.fetch_add(result.len(), Ordering::SeqCst);
+                            lock(&results).extend(result);
                         },
                         Err(e) => {
-                            println!("Worker {} error: {}", worker_id, e);
+                            errors.fetch_add(1, Ordering::SeqCst);
+                            let message = format!("{}: {}", data, e);
+                            utils::debug(&format!("Worker {} error: {}", worker_id, message));
+                            lock(&error_log).push(message);
                         }
                     }
                 }
@@ -81,29 +167,53 @@ impl Orchestrator {
 
         // Feed data to workers
         {
-            let data_queue = self.data_queue.lock().unwrap();
+            let data_queue = lock(&self.data_queue);
             for data in data_queue.iter() {
-                tx.send(data.clone()).unwrap();
+                if self.error_limit_reached() || self.stopped() {
+                    break;
+                }
+                // Sending only fails once every worker is gone
+                if tx.send(data.clone()).is_err() {
+                    self.record_error("All workers exited before the data queue was drained".to_string());
+                    break;
+                }
             }
         }
         
         // Signal workers to finish
         drop(tx);
         
-        // Wait for all workers to complete
-        for handle in handles {
-            handle.join().unwrap();
+        // Wait for all workers to complete, a worker that died is reported instead of taking the crawl down
+        for (worker_id, handle) in handles.into_iter().enumerate() {
+            if let Err(panic) = handle.join() {
+                self.record_error(format!("Worker {} died: {}", worker_id, utils::recover::panic_message(&panic)));
+            }
         }
         
         // Return results
-        let mut results = self.results.lock().unwrap();
+        let mut results = lock(&self.results);
         let results_clone = results.clone();
 
         results.clear();
         Ok(results_clone)
     }
 
+    fn record_error(&self, message: String) {
+        self.errors.fetch_add(1, Ordering::SeqCst);
+        utils::debug(&message);
+        lock(&self.error_log).push(message);
+    }
+
     pub fn relinquish_plugin(&self) -> Arc<Plugin> {
         self.plugin.clone()
     }
-} 
\ No newline at end of file
+}
+
+/// Lock a mutex, recovering the data if a panicking thread poisoned it
+fn lock<T>(mutex: &Mutex<T>) -> MutexGuard<'_, T> {
+    mutex.lock().unwrap_or_else(|poisoned| poisoned.into_inner())
+}
+
+fn error_limit_reached(errors: &AtomicUsize, max_errors: usize) -> bool {
+    max_errors > 0 && errors.load(Ordering::SeqCst) > max_errors
+}
@@ -1,14 +1,35 @@
+use std::collections::HashMap;
 use std::fs;
 use std::path::Path;
 use std::process::Command;
+use std::sync::{Mutex, OnceLock};
+use std::time::{Duration, Instant};
 use pyo3::prelude::*;
 use pyo3::types::{PyDict, PyList, PyString};
 use pyo3::PyObject;
 
 use crate::utils;
+use crate::utils::errors::{PluginError, PluginErrorKind};
 
 const IGNORE_KEYS: [&str; 3] = ["name", "description", "version"];
 
+static PYTHON_PATHS: OnceLock<String> = OnceLock::new();
+
+/// `valradar.suspend_progress(callback)`, calls `callback` with the progress bar cleared from the terminal
+/// so a plugin prompting the user isn't drawn over, and returns what it returns
+#[pyfunction]
+fn suspend_progress(py: Python<'_>, callback: PyObject) -> PyResult<PyObject> {
+    // The GIL is let go while waiting for the bar, which may be drawing from another thread
+    py.allow_threads(|| utils::progress::suspend(|| Python::with_gil(|py| callback.call0(py))))
+}
+
+/// The `valradar` module plugins can import to reach back into valradar
+fn register_valradar_module(py: Python<'_>) -> PyResult<()> {
+    let module = PyModule::new(py, "valradar")?;
+    module.add_function(wrap_pyfunction!(suspend_progress, module)?)?;
+    PyModule::import(py, "sys")?.getattr("modules")?.set_item("valradar", module)
+}
+
 struct PluginMetadata<'a>(&'a PyDict);
 
 impl<'a> PluginMetadata<'a> {
@@ -26,15 +47,38 @@ impl<'a> PluginMetadata<'a> {
     }
 }
 
+/// How often a plugin hook was called and how long the calls took altogether
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct HookTiming {
+    pub hook: &'static str,
+    pub calls: u64,
+    pub total: Duration,
+}
+
+impl HookTiming {
+    pub fn mean(&self) -> Duration {
+        if self.calls == 0 { Duration::ZERO } else { self.total / self.calls as u32 }
+    }
+}
+
 #[derive(Debug)]
 pub struct Plugin {
     pub name: String,
     pub path: String,
     code: String,
+    /// The plugin module and its `VALRADAR_CONFIG`, the module is executed once and kept for every hook
+    loaded: OnceLock<(PyObject, PyObject)>,
+    /// Calls and time spent per hook since the last `reset_hook_timings`, `load` is executing the module
+    timings: Mutex<HashMap<&'static str, (u64, Duration)>>,
 }
 
 impl Plugin {
-    fn get_existing_python_paths(py: Python<'_>) -> anyhow::Result<&PyList> {
+    /// `sys.path` of the system python, looked up once since spawning python on every plugin call dominates small runs
+    fn python_paths_source() -> anyhow::Result<&'static str> {
+        if let Some(paths) = PYTHON_PATHS.get() {
+            return Ok(paths);
+        }
+
         let mut python_command =Command::new("python")
             .arg("-c")
             .arg("import sys; print(sys.path)")
@@ -43,7 +87,7 @@ impl Plugin {
         let output_string;
 
         if let Ok(output) = python_command {
-            output_string = String::from_utf8(output.stdout).unwrap();
+            output_string = String::from_utf8(output.stdout)?;
         } else {
             python_command = Command::new("python3")
                 .arg("-c")
@@ -51,42 +95,92 @@ impl Plugin {
                 .output();
 
             if let Ok(output) = python_command {
-                output_string = String::from_utf8(output.stdout).unwrap();
+                output_string = String::from_utf8(output.stdout)?;
             } else {
                 return Err(anyhow::anyhow!("Failed to get python paths: neither python nor python3 is available"));
             }
         }
 
-        match Python::eval(py, output_string.as_str(), None, None) {
+        Ok(PYTHON_PATHS.get_or_init(|| output_string))
+    }
+
+    fn get_existing_python_paths(py: Python<'_>) -> anyhow::Result<&PyList> {
+        let output_string = Self::python_paths_source()?;
+
+        match Python::eval(py, output_string, None, None) {
             Ok(path_list) => Ok(path_list.extract::<&PyList>()?),
             Err(e) => Err(anyhow::anyhow!(e)),
         }
     }
 
+    /// A `PluginError` for this plugin, the library's embedders look for it with `downcast_ref`
+    fn hook_error(&self, hook: &'static str, kind: PluginErrorKind, cause: impl ToString) -> anyhow::Error {
+        anyhow::Error::new(PluginError { plugin: self.name.clone(), hook, kind, cause: cause.to_string() })
+    }
+
     pub fn new(name: String, path: String) -> Self {
         let code = fs::read_to_string(&path).unwrap_or_else(|_| String::new());
-        Self { name, path, code }
+        Self { name, path, code, loaded: OnceLock::new(), timings: Mutex::new(HashMap::new()) }
+    }
+
+    /// Run `f`, counting it as a call of `hook`
+    fn timed<R>(&self, hook: &'static str, f: impl FnOnce() -> R) -> R {
+        let started = Instant::now();
+        let result = f();
+        let mut timings = self.timings.lock().unwrap_or_else(|poisoned| poisoned.into_inner());
+        let timing = timings.entry(hook).or_default();
+        timing.0 += 1;
+        timing.1 += started.elapsed();
+        result
+    }
+
+    /// Calls and time spent per hook since the last reset, the slowest overall first
+    pub fn hook_timings(&self) -> Vec<HookTiming> {
+        let timings = self.timings.lock().unwrap_or_else(|poisoned| poisoned.into_inner());
+        let mut timings = timings.iter().map(|(hook, (calls, total))| HookTiming { hook: *hook, calls: *calls, total: *total }).collect::<Vec<HookTiming>>();
+        timings.sort_by(|a, b| b.total.cmp(&a.total).then(a.hook.cmp(b.hook)));
+        timings
+    }
+
+    pub fn reset_hook_timings(&self) {
+        self.timings.lock().unwrap_or_else(|poisoned| poisoned.into_inner()).clear();
     }
 
+    /// The plugin module and its config, executing the module the first time
+    ///
+    /// Module level state such as sessions or caches lasts for the life of the plugin.
     fn create_interpreter(&self) -> anyhow::Result<(PyObject, PyObject)> {
         Python::with_gil(|py| {
-            let plugin_name = Path::new(&self.name).file_name().unwrap();
+            // The first hook called, metadata or init, runs before any worker starts, so the module is executed once
+            if let Some((plugin, config)) = self.loaded.get() {
+                return Ok((plugin.clone_ref(py), config.clone_ref(py)));
+            }
+
+            let plugin_name = match Path::new(&self.name).file_name().and_then(|name| name.to_str()) {
+                Some(plugin_name) => plugin_name,
+                None => return Err(anyhow::anyhow!("Invalid plugin name: '{}'", self.name)),
+            };
             let sys = PyModule::import(py, "sys")?;
             let existing_paths = Self::get_existing_python_paths(py)?;
             utils::debug(&format!("Existing paths: {:?}", existing_paths));
             let _ = sys.setattr("path", existing_paths);
             utils::debug(&format!("Sys path: {:?}", sys.getattr("path")?));
+            register_valradar_module(py)?;
             
-            let plugin = PyModule::from_code(py, &self.code, &self.path, plugin_name.to_str().unwrap())?;
-            let config = plugin.getattr("VALRADAR_CONFIG")?;
-            
-            Ok((plugin.into(), config.into()))
+            let plugin = self.timed("load", || PyModule::from_code(py, &self.code, &self.path, plugin_name))
+                .map_err(|e| self.hook_error("load", PluginErrorKind::Raised, e))?;
+            let config = plugin.getattr("VALRADAR_CONFIG")
+                .map_err(|_| self.hook_error("load", PluginErrorKind::Raised, "the module doesn't define VALRADAR_CONFIG"))?;
+
+            let loaded: (PyObject, PyObject) = (plugin.into(), config.into());
+            let _ = self.loaded.set((loaded.0.clone_ref(py), loaded.1.clone_ref(py)));
+            Ok(loaded)
         })
     }
 
     pub fn get_metadata(&self) -> anyhow::Result<utils::PluginMetadata> {
         let (_plugin, config) = self.create_interpreter()?;
-        let result = Python::with_gil(|py| {
+        let result = self.timed("metadata", || Python::with_gil(|py| {
             let config = match config.extract::<&PyDict>(py) {
                 Ok(config) => config,
                 Err(e) => {
@@ -136,23 +230,39 @@ impl Plugin {
                 description: plugin_metadata.get_value("description")?,
                 remaining,
             })
-        });
+        }));
 
         return result;
     }
 
+    /// Result columns the plugin lists in `volatile_fields`, values that change every time a finding is seen
+    pub fn volatile_fields(&self) -> anyhow::Result<Vec<String>> {
+        let (_plugin, config) = self.create_interpreter()?;
+
+        Python::with_gil(|py| {
+            let config = config.extract::<&PyDict>(py)?;
+            // volatile_fields is optional
+            match config.get_item("volatile_fields")? {
+                Some(fields) => fields.extract::<Vec<String>>()
+                    .map_err(|e| anyhow::anyhow!("VALRADAR_CONFIG[\"volatile_fields\"] must be a list of column names: {}", e)),
+                None => Ok(vec![]),
+            }
+        })
+    }
+
     pub fn init(&self, args: &[String]) -> anyhow::Result<Vec<utils::ExecutionContext>> {
         let (_plugin, config) = self.create_interpreter()?;
         
-        let result = Python::with_gil(|py| {
+        let result = self.timed("init", || Python::with_gil(|py| {
             let config = config.extract::<&PyDict>(py)?;
             let args_list = PyList::empty(py);
             for arg in args {
-                args_list.append(arg).unwrap();
+                args_list.append(arg)?;
             }
 
             let init_func = match config.get_item("init") {
-                Ok(init_func) => init_func.unwrap(),
+                Ok(Some(init_func)) => init_func,
+                Ok(None) => return Err(self.hook_error("init", PluginErrorKind::Missing, "")),
                 Err(e) => {
                     utils::debug(&format!("Failed to get init function: {}", e));
                     return Err(anyhow::anyhow!(e));
@@ -163,7 +273,7 @@ impl Plugin {
                 Ok(value) => value,
                 Err(e) => {
                     utils::debug(&format!("Failed to call init function: {}", e));
-                    return Err(anyhow::anyhow!(e));
+                    return Err(self.hook_error("init", PluginErrorKind::Raised, e));
                 },
             };
 
@@ -172,9 +282,9 @@ impl Plugin {
             if let Ok(initial_data) = result.extract::<&PyList>() {
                 Ok(initial_data.into_iter().map(|value| utils::ExecutionContext::new(value.into())).collect())
             } else {
-                Err(anyhow::anyhow!("Init function execution failed"))
+                Err(self.hook_error("init", PluginErrorKind::InvalidReturn, "expected a list of contexts"))
             }
-        });
+        }));
 
         return result;
     }
@@ -182,10 +292,11 @@ impl Plugin {
     pub fn collect_data(&self, data: &utils::ExecutionContext) -> anyhow::Result<Vec<utils::ExecutionContext>> {
         let (_, config) = self.create_interpreter()?;
         
-        let result = Python::with_gil(|py| {
+        let result = self.timed("collect_data", || Python::with_gil(|py| {
             let config = config.extract::<&PyDict>(py)?;
             let collect_data_func = match config.get_item("collect_data") {
-                Ok(collect_data_func) => collect_data_func.unwrap(),
+                Ok(Some(collect_data_func)) => collect_data_func,
+                Ok(None) => return Err(self.hook_error("collect_data", PluginErrorKind::Missing, "")),
                 Err(e) => {
                     utils::debug(&format!("Failed to get collect_data function: {}", e));
                     return Err(anyhow::anyhow!(e));
@@ -196,27 +307,29 @@ impl Plugin {
                 Ok(value) => value,
                 Err(e) => {
                     utils::debug(&format!("Failed to call collect_data function: {}", e));
-                    return Err(anyhow::anyhow!(e));
+                    return Err(self.hook_error("collect_data", PluginErrorKind::Raised, e));
                 },
             };
 
             if let Ok(collected_data) = result.extract::<&PyList>() {
                 Ok(collected_data.into_iter().map(|value| utils::ExecutionContext::new(value.into())).collect())
             } else {
-                Err(anyhow::anyhow!("Collect data function returned a non-list value"))
+                Err(self.hook_error("collect_data", PluginErrorKind::InvalidReturn, "expected a list of contexts"))
             }
-        });
+        }));
 
         return result;
     }
     
-    pub fn process_data(&self, data: &utils::ExecutionContext) -> anyhow::Result<utils::ProcessingResult> {
+    /// Process a context, `None` means the plugin had nothing to report for it
+    pub fn process_data(&self, data: &utils::ExecutionContext) -> anyhow::Result<Option<utils::ProcessingResult>> {
         let (_, config) = self.create_interpreter()?;
         
-        let result = Python::with_gil(|py| {
+        let result = self.timed("process_data", || Python::with_gil(|py| {
             let config = config.extract::<&PyDict>(py)?;
             let process_data_func = match config.get_item("process_data") {
-                Ok(process_data_func) => process_data_func.unwrap(),
+                Ok(Some(process_data_func)) => process_data_func,
+                Ok(None) => return Err(self.hook_error("process_data", PluginErrorKind::Missing, "")),
                 Err(e) => {
                     utils::debug(&format!("Failed to get process_data function: {}", e));
                     return Err(anyhow::anyhow!(e));
@@ -227,18 +340,144 @@ impl Plugin {
                 Ok(value) => value,
                 Err(e) => {
                     utils::debug(&format!("Failed to call process_data function: {}", e));
-                    return Err(anyhow::anyhow!(e));
+                    return Err(self.hook_error("process_data", PluginErrorKind::Raised, e));
                 },
             };
 
+            if result.is_none() {
+                return Ok(None);
+            }
+
             if let Ok(processed_data) = result.extract::<&PyDict>() {
-                let keys = processed_data.keys().into_iter().map(|key| key.extract::<&PyString>().unwrap().to_string()).collect();
-                let values = processed_data.values().into_iter().map(|value| value.extract::<&PyString>().unwrap().to_string()).collect();
-                Ok(utils::ProcessingResult::new(keys, values))
+                let mut keys = vec![];
+                let mut values = vec![];
+                for (key, value) in processed_data.iter() {
+                    keys.push(key.str()?.to_string());
+                    values.push(value.str()?.to_string());
+                }
+                Ok(Some(utils::ProcessingResult::new(keys, values)))
+            } else {
+                Err(self.hook_error("process_data", PluginErrorKind::InvalidReturn, "expected a dict or None"))
+            }
+        }));
+
+        return result;
+    }
+
+    /// Validate the plugin arguments without collecting anything
+    ///
+    /// Calls the optional `check` hook, which returns one dict per thing it validated with a
+    /// `valid` bool. `None` means the plugin has no hook, so only loading it was validated.
+    pub fn check(&self, args: &[String]) -> anyhow::Result<Option<Vec<(bool, utils::ProcessingResult)>>> {
+        let (_, config) = self.create_interpreter()?;
+
+        let result = self.timed("check", || Python::with_gil(|py| {
+            let config = config.extract::<&PyDict>(py)?;
+            let check_func = match config.get_item("check") {
+                Ok(Some(check_func)) => check_func,
+                Ok(None) => return Ok(None),
+                Err(e) => {
+                    utils::debug(&format!("Failed to get check function: {}", e));
+                    return Err(anyhow::anyhow!(e));
+                },
+            };
+
+            let args_list = PyList::empty(py);
+            for arg in args {
+                args_list.append(arg)?;
+            }
+
+            let result = match check_func.call((args_list,), None) {
+                Ok(value) => value,
+                Err(e) => {
+                    utils::debug(&format!("Failed to call check function: {}", e));
+                    return Err(self.hook_error("check", PluginErrorKind::Raised, e));
+                },
+            };
+
+            let Ok(checks) = result.extract::<&PyList>() else {
+                return Err(self.hook_error("check", PluginErrorKind::InvalidReturn, "expected a list of dicts"));
+            };
+
+            let mut results = vec![];
+            for check in checks {
+                let check = check.extract::<&PyDict>()
+                    .map_err(|_| self.hook_error("check", PluginErrorKind::InvalidReturn, "expected a list of dicts"))?;
+                let valid = match check.get_item("valid")? {
+                    Some(valid) => valid.is_true()?,
+                    None => return Err(self.hook_error("check", PluginErrorKind::InvalidReturn, "a result has no 'valid' key")),
+                };
+
+                let mut keys = vec![];
+                let mut values = vec![];
+                for (key, value) in check.iter() {
+                    keys.push(key.str()?.to_string());
+                    values.push(value.str()?.to_string());
+                }
+                results.push((valid, utils::ProcessingResult::new(keys, values)));
+            }
+
+            Ok(Some(results))
+        }));
+
+        return result;
+    }
+
+    /// Flush python's stdout and stderr
+    ///
+    /// The embedded interpreter is never finalized, so anything a plugin printed into a
+    /// pipe would otherwise still be buffered (or lost) when valradar exits.
+    pub fn flush_output() -> anyhow::Result<()> {
+        Python::with_gil(|py| {
+            py.run("import sys\nsys.stdout.flush()\nsys.stderr.flush()", None, None)?;
+            Ok(())
+        })
+    }
+
+    pub fn finish(&self, data: &[utils::ExecutionContext]) -> anyhow::Result<Option<utils::ProcessingResult>> {
+        let (_, config) = self.create_interpreter()?;
+
+        let result = self.timed("finish", || Python::with_gil(|py| {
+            let config = config.extract::<&PyDict>(py)?;
+            // The finish hook is optional
+            let finish_func = match config.get_item("finish") {
+                Ok(Some(finish_func)) => finish_func,
+                Ok(None) => return Ok(None),
+                Err(e) => {
+                    utils::debug(&format!("Failed to get finish function: {}", e));
+                    return Err(anyhow::anyhow!(e));
+                },
+            };
+
+            let contexts = PyList::empty(py);
+            for context in data {
+                contexts.append(context.as_pyobject())?;
+            }
+
+            let result = match finish_func.call((contexts,), None) {
+                Ok(value) => value,
+                Err(e) => {
+                    utils::debug(&format!("Failed to call finish function: {}", e));
+                    return Err(self.hook_error("finish", PluginErrorKind::Raised, e));
+                },
+            };
+
+            if result.is_none() {
+                return Ok(None);
+            }
+
+            if let Ok(summary) = result.extract::<&PyDict>() {
+                let mut keys = vec![];
+                let mut values = vec![];
+                for (key, value) in summary.iter() {
+                    keys.push(key.str()?.to_string());
+                    values.push(value.str()?.to_string());
+                }
+                Ok(Some(utils::ProcessingResult::new(keys, values)))
             } else {
-                Err(anyhow::anyhow!("Process data function returned a non-dict value"))
+                Err(self.hook_error("finish", PluginErrorKind::InvalidReturn, "expected a dict or None"))
             }
-        });
+        }));
 
         return result;
     }
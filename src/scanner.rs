@@ -0,0 +1,497 @@
+use std::sync::{Arc, Mutex};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::thread::{self, JoinHandle};
+use std::time::{Duration, Instant};
+use indicatif::{ProgressBar, ProgressStyle};
+
+use crate::orchestrator::{CollectionProgress, Orchestrator};
+use crate::plugin::{HookTiming, Plugin};
+use crate::utils;
+
+/// Everything produced by a single run of the pipeline
+pub struct ScanReport {
+    pub results: Vec<utils::ProcessingResult>,
+    pub summary: Option<utils::ProcessingResult>,
+    pub errors: Vec<String>,
+    pub collected: usize,
+    pub duration: Duration,
+    /// Why collection ended before the depth was reached, `max-duration`, `idle` or `signal`
+    pub stopped: Option<&'static str>,
+    /// Calls and time spent per plugin hook during the scan, the slowest overall first
+    pub hook_timings: Vec<HookTiming>,
+}
+
+impl ScanReport {
+    /// A single line with stable `key=value` pairs for scripts parsing the human output
+    pub fn summary_line(&self) -> String {
+        let line = format!(
+            "SUMMARY collected={} results={} errors={} duration={:.1}s",
+            self.collected,
+            self.results.len(),
+            self.errors.len(),
+            self.duration.as_secs_f64()
+        );
+        match self.stopped {
+            Some(reason) => format!("{} stopped={}", line, reason),
+            None => line,
+        }
+    }
+
+    /// A `HOOK` line per plugin hook with stable `key=value` pairs, the slowest overall first
+    pub fn hook_timing_lines(&self) -> Vec<String> {
+        self.hook_timings
+            .iter()
+            .map(|timing| format!("HOOK name={} calls={} total={:.3}s mean={:.3}ms", timing.hook, timing.calls, timing.total.as_secs_f64(), timing.mean().as_secs_f64() * 1000.0))
+            .collect()
+    }
+}
+
+/// Runs a plugin's init -> collect -> process -> finish pipeline, the library side of the CLI
+///
+/// ```no_run
+/// use valradar::{Plugin, Scanner};
+///
+/// let plugin = Plugin::new("regex".to_string(), "modules/web/regex.py".to_string());
+/// let mut scanner = Scanner::builder(plugin)
+///     .concurrency(10)
+///     .depth(3)
+///     .args(vec!["https://example.com".to_string(), "-t".to_string(), "aws=AKIA[0-9A-Z]{16}".to_string()])
+///     .build()?;
+/// let report = scanner.scan()?;
+/// # Ok::<(), anyhow::Error>(())
+/// ```
+pub struct Scanner {
+    orchestrator: Orchestrator,
+    depth: u32,
+    max_errors: usize,
+    args: Vec<String>,
+    progress: bool,
+    progress_json: bool,
+    max_duration: Option<Duration>,
+    idle_timeout: Option<Duration>,
+    stop_on_signal: bool,
+}
+
+/// Options of a `Scanner`, each one matching the CLI flag of the same name
+pub struct ScannerBuilder {
+    plugin: Plugin,
+    concurrency: usize,
+    depth: u32,
+    max_errors: usize,
+    args: Vec<String>,
+    progress: bool,
+    progress_json: bool,
+    max_duration: Option<Duration>,
+    idle_timeout: Option<Duration>,
+    stop_on_signal: bool,
+}
+
+impl Scanner {
+    /// Start configuring a scanner for `plugin`, the defaults are the CLI's
+    pub fn builder(plugin: Plugin) -> ScannerBuilder {
+        ScannerBuilder {
+            plugin,
+            concurrency: 4,
+            depth: 1,
+            max_errors: 0,
+            args: vec![],
+            progress: false,
+            progress_json: false,
+            max_duration: None,
+            idle_timeout: None,
+            stop_on_signal: false,
+        }
+    }
+
+    /// Replace the arguments handed to the plugin's init, used from the next `scan` on
+    pub fn set_args(&mut self, args: Vec<String>) {
+        self.args = args;
+    }
+
+    /// Run the collect -> process pipeline once and return the processed results
+    ///
+    /// The plugin is initialized from scratch every time, so a scanner can be run repeatedly.
+    pub fn scan(&mut self) -> anyhow::Result<ScanReport> {
+        let started = Instant::now();
+        self.orchestrator.relinquish_plugin().reset_hook_timings();
+        let bar = if self.progress { ProgressBar::new_spinner() } else { ProgressBar::hidden() };
+        bar.enable_steady_tick(Duration::from_millis(100));
+        bar.set_message("Initializing plugin...");
+        // Plugins prompting on the terminal hide it meanwhile, see `valradar.suspend_progress`
+        utils::progress::set_active(Some(bar.clone()));
+
+        let events = self.progress_json.then(|| ProgressEvents::start(self.orchestrator.progress(), started));
+
+        // Orchestrator depth
+        let mut depth = self.depth;
+
+        match self.orchestrator.init(&self.args) {
+            Ok(_) => {
+                utils::debug("Plugin initialized");
+            },
+            Err(e) => {
+                bar.finish_and_clear();
+                utils::progress::set_active(None);
+                if let Some(events) = events {
+                    events.stop();
+                }
+                return Err(e.context("Plugin initialization failed"));
+            },
+        };
+
+        // The contexts returned by init are results too, a resumed plugin hands back finished work this way
+        let mut all_results: Vec<utils::ExecutionContext> = self.orchestrator.queued();
+        let mut queued = all_results.len();
+
+        let limits = (self.max_duration.is_some() || self.idle_timeout.is_some() || self.stop_on_signal).then(|| {
+            CrawlLimits::start(self.orchestrator.stop_flag(), self.orchestrator.progress(), started, self.max_duration, self.idle_timeout, self.stop_on_signal)
+        });
+
+        while depth > 0 {
+            if let Some(events) = &events {
+                events.update(|state| {
+                    state.depth = self.depth - depth + 1;
+                    state.queued = queued;
+                });
+            }
+            bar.set_message(format!("Collecting at depth [{}/{}] with {} results collected", self.depth - depth + 1, self.depth, all_results.len()));
+            // Run the orchestrator to process all current data
+            let results = match self.orchestrator.run() {
+                Ok(results) => {
+                    utils::debug(&format!("Collecting completed with {} results", results.len()));
+                    results
+                },
+                Err(e) => {
+                    println!("Collecting failed: {}", e);
+                    vec![]
+                }
+            };
+
+            all_results.extend(results.clone());
+            queued += results.len();
+            self.orchestrator.set_data_queue(results.clone());
+
+            if self.orchestrator.error_limit_reached() {
+                bar.println(format!("Aborting collection early: {} collection errors exceeded --max-errors {}", self.orchestrator.error_count(), self.max_errors));
+                break;
+            }
+
+            if self.orchestrator.stopped() {
+                break;
+            }
+
+            // Nothing left to collect, the remaining depth would only run empty rounds
+            if results.is_empty() {
+                break;
+            }
+
+            // Decrement the depth
+            depth -= 1;
+        }
+
+        let stopped = limits.and_then(CrawlLimits::finish);
+        match stopped {
+            Some("idle") => bar.println(format!("Stopping collection early: nothing new was discovered for {}s", self.idle_timeout.unwrap_or_default().as_secs())),
+            Some("signal") => bar.println("Stopping collection early: interrupted, processing what was collected so far"),
+            Some(_) => bar.println(format!("Stopping collection early: --max-duration of {}s reached", self.max_duration.unwrap_or_default().as_secs())),
+            None => {},
+        }
+
+        bar.set_message(format!("Collected {} results", all_results.len()));
+        bar.set_prefix("✅");
+        bar.finish();
+
+        let plugin = self.orchestrator.relinquish_plugin();
+
+        let processing_bar = if self.progress { ProgressBar::new(all_results.len().try_into().unwrap()) } else { ProgressBar::hidden() };
+        processing_bar.set_style(ProgressStyle::with_template("[{elapsed_precise}] {bar:80.cyan/blue} {pos:>7}/{len:7} {msg}")
+            .unwrap()
+            .progress_chars("##-"));
+        processing_bar.set_message("Processing results...");
+        utils::progress::set_active(Some(processing_bar.clone()));
+
+        if let Some(events) = &events {
+            events.update(|state| state.stage = "processing");
+        }
+
+        let mut processing_results: Vec<utils::ProcessingResult> = vec![];
+        let mut errors = self.orchestrator.take_errors();
+        for result in &all_results {
+            let processing_result = utils::recover::catch("process_data", || plugin.process_data(result));
+            processing_bar.inc(1);
+            if let Some(events) = &events {
+                let matched = matches!(processing_result, Ok(Some(_)));
+                events.quiet_update(|state| {
+                    state.processed += 1;
+                    state.results += matched as usize;
+                });
+            }
+            match processing_result {
+                Ok(Some(processing_result)) => processing_results.push(processing_result),
+                Ok(None) => {},
+                Err(e) => {
+                    utils::debug(&format!("Skipped processing result: {}", e));
+                    errors.push(format!("{}: {}", result, e));
+                }
+            }
+        }
+
+        processing_bar.set_message("Processing completed");
+        processing_bar.finish();
+        utils::progress::set_active(None);
+
+        let summary = match utils::recover::catch("finish", || plugin.finish(&all_results)) {
+            Ok(summary) => summary,
+            Err(e) => {
+                errors.push(format!("Plugin finish failed: {}", e));
+                None
+            },
+        };
+
+        if let Some(events) = events {
+            events.stop();
+        }
+
+        // Plugin output comes before the report even when stdout is a pipe
+        if let Err(e) = Plugin::flush_output() {
+            utils::debug(&format!("Failed to flush plugin output: {}", e));
+        }
+
+        Ok(ScanReport {
+            results: processing_results,
+            summary,
+            errors,
+            collected: all_results.len(),
+            duration: started.elapsed(),
+            stopped,
+            hook_timings: plugin.hook_timings(),
+        })
+    }
+}
+
+impl ScannerBuilder {
+    /// Worker threads collecting in parallel, `--concurrency`
+    pub fn concurrency(mut self, concurrency: usize) -> Self {
+        self.concurrency = concurrency;
+        self
+    }
+
+    /// How many rounds of collection to run, `--depth`
+    pub fn depth(mut self, depth: u32) -> Self {
+        self.depth = depth;
+        self
+    }
+
+    /// Abort collection after more than this many errors, 0 disables the limit, `--max-errors`
+    pub fn max_errors(mut self, max_errors: usize) -> Self {
+        self.max_errors = max_errors;
+        self
+    }
+
+    /// Arguments handed to the plugin's init, where plugin specific options such as patterns go
+    pub fn args(mut self, args: Vec<String>) -> Self {
+        self.args = args;
+        self
+    }
+
+    /// Draw progress bars on the terminal while scanning, off by default for embedders
+    pub fn progress(mut self, progress: bool) -> Self {
+        self.progress = progress;
+        self
+    }
+
+    /// Write progress events as JSON lines to stderr instead of drawing bars, `--progress-json`
+    pub fn progress_json(mut self, progress_json: bool) -> Self {
+        self.progress_json = progress_json;
+        self
+    }
+
+    /// End collection once the scan ran this long and process what was collected, `--max-duration`
+    pub fn max_duration(mut self, max_duration: Option<Duration>) -> Self {
+        self.max_duration = max_duration;
+        self
+    }
+
+    /// End collection once nothing new was discovered for this long, `--idle-timeout`
+    pub fn idle_timeout(mut self, idle_timeout: Option<Duration>) -> Self {
+        self.idle_timeout = idle_timeout;
+        self
+    }
+
+    /// End collection once a shutdown signal came in, so the plugin's finish still runs and can save its state
+    ///
+    /// Only has an effect with a handler from `utils::signal::install_shutdown_handler` installed.
+    pub fn stop_on_signal(mut self, stop_on_signal: bool) -> Self {
+        self.stop_on_signal = stop_on_signal;
+        self
+    }
+
+    pub fn build(self) -> anyhow::Result<Scanner> {
+        if self.concurrency == 0 {
+            return Err(anyhow::anyhow!("Concurrency must be at least 1"));
+        }
+        if self.progress && self.progress_json {
+            return Err(anyhow::anyhow!("Progress bars and JSON progress events can't be used together"));
+        }
+
+        let mut orchestrator = Orchestrator::new(self.plugin, self.concurrency);
+        orchestrator.set_max_errors(self.max_errors);
+
+        Ok(Scanner {
+            orchestrator,
+            depth: self.depth,
+            max_errors: self.max_errors,
+            args: self.args,
+            progress: self.progress,
+            progress_json: self.progress_json,
+            max_duration: self.max_duration,
+            idle_timeout: self.idle_timeout,
+            stop_on_signal: self.stop_on_signal,
+        })
+    }
+}
+
+/// How often progress events are written while nothing else happens
+const PROGRESS_INTERVAL: Duration = Duration::from_secs(1);
+
+/// What the scan is doing, beside the counters kept by the orchestrator
+struct ProgressState {
+    stage: &'static str,
+    depth: u32,
+    /// Contexts queued for collection so far, collected ones included
+    queued: usize,
+    processed: usize,
+    results: usize,
+}
+
+/// Writes `{"event": "progress", ...}` lines to stderr on every stage change and every `PROGRESS_INTERVAL`
+struct ProgressEvents {
+    state: Arc<Mutex<ProgressState>>,
+    collection: Arc<CollectionProgress>,
+    started: Instant,
+    done: Arc<AtomicBool>,
+    handle: JoinHandle<()>,
+}
+
+impl ProgressEvents {
+    fn start(collection: Arc<CollectionProgress>, started: Instant) -> Self {
+        let state = Arc::new(Mutex::new(ProgressState { stage: "collecting", depth: 0, queued: 0, processed: 0, results: 0 }));
+        let done = Arc::new(AtomicBool::new(false));
+
+        let handle = {
+            let (state, collection, done) = (Arc::clone(&state), Arc::clone(&collection), Arc::clone(&done));
+            thread::spawn(move || {
+                let mut last = Instant::now();
+                while !done.load(Ordering::SeqCst) {
+                    // Short sleeps so stopping doesn't wait for a whole interval
+                    thread::sleep(Duration::from_millis(100));
+                    if last.elapsed() >= PROGRESS_INTERVAL {
+                        emit(&state, &collection, started);
+                        last = Instant::now();
+                    }
+                }
+            })
+        };
+
+        Self { state, collection, started, done, handle }
+    }
+
+    /// Change the state and write an event right away
+    fn update(&self, change: impl FnOnce(&mut ProgressState)) {
+        self.quiet_update(change);
+        emit(&self.state, &self.collection, self.started);
+    }
+
+    /// Change the state, it is written with the next periodic event
+    fn quiet_update(&self, change: impl FnOnce(&mut ProgressState)) {
+        change(&mut self.state.lock().unwrap_or_else(|poisoned| poisoned.into_inner()));
+    }
+
+    /// Write the final `done` event and stop the periodic ones
+    fn stop(self) {
+        let Self { state, collection, started, done, handle } = self;
+        done.store(true, Ordering::SeqCst);
+        let _ = handle.join();
+        state.lock().unwrap_or_else(|poisoned| poisoned.into_inner()).stage = "done";
+        emit(&state, &collection, started);
+    }
+}
+
+fn emit(state: &Mutex<ProgressState>, collection: &CollectionProgress, started: Instant) {
+    let state = state.lock().unwrap_or_else(|poisoned| poisoned.into_inner());
+    let crawled = collection.collected.load(Ordering::SeqCst);
+    let elapsed = started.elapsed().as_secs_f64();
+
+    let event = serde_json::json!({
+        "event": "progress",
+        "stage": state.stage,
+        "depth": state.depth,
+        "crawled": crawled,
+        "queued": state.queued.saturating_sub(crawled),
+        "discovered": collection.discovered.load(Ordering::SeqCst),
+        "processed": state.processed,
+        "results": state.results,
+        "rate": if elapsed > 0.0 { (crawled as f64 / elapsed * 10.0).round() / 10.0 } else { 0.0 },
+        "elapsed": (elapsed * 10.0).round() / 10.0,
+    });
+    eprintln!("{}", event);
+}
+
+/// Sets the orchestrator's stop flag once `max_duration` passed, nothing new was discovered for `idle_timeout`
+/// or, with `stop_on_signal`, a shutdown signal came in
+///
+/// Discovery is counted by the contexts collecting returns, so a crawl that is only
+/// working through slow or already visited resources is idle too.
+struct CrawlLimits {
+    reason: Arc<Mutex<Option<&'static str>>>,
+    done: Arc<AtomicBool>,
+    handle: JoinHandle<()>,
+}
+
+impl CrawlLimits {
+    fn start(stop: Arc<AtomicBool>, collection: Arc<CollectionProgress>, started: Instant, max_duration: Option<Duration>, idle_timeout: Option<Duration>, stop_on_signal: bool) -> Self {
+        let reason = Arc::new(Mutex::new(None));
+        let done = Arc::new(AtomicBool::new(false));
+
+        let handle = {
+            let (reason, done) = (Arc::clone(&reason), Arc::clone(&done));
+            thread::spawn(move || {
+                let mut discovered = collection.discovered.load(Ordering::SeqCst);
+                let mut last_discovery = Instant::now();
+                while !done.load(Ordering::SeqCst) {
+                    thread::sleep(Duration::from_millis(100));
+
+                    let now_discovered = collection.discovered.load(Ordering::SeqCst);
+                    if now_discovered != discovered {
+                        discovered = now_discovered;
+                        last_discovery = Instant::now();
+                    }
+
+                    let exceeded = if stop_on_signal && utils::signal::shutdown_requested() {
+                        Some("signal")
+                    } else if max_duration.is_some_and(|max_duration| started.elapsed() >= max_duration) {
+                        Some("max-duration")
+                    } else if idle_timeout.is_some_and(|idle_timeout| last_discovery.elapsed() >= idle_timeout) {
+                        Some("idle")
+                    } else {
+                        None
+                    };
+                    if exceeded.is_some() {
+                        *reason.lock().unwrap_or_else(|poisoned| poisoned.into_inner()) = exceeded;
+                        stop.store(true, Ordering::SeqCst);
+                        return;
+                    }
+                }
+            })
+        };
+
+        Self { reason, done, handle }
+    }
+
+    /// Stop watching, returns why collection was stopped if it was
+    fn finish(self) -> Option<&'static str> {
+        self.done.store(true, Ordering::SeqCst);
+        let _ = self.handle.join();
+        self.reason.lock().unwrap_or_else(|poisoned| poisoned.into_inner()).take()
+    }
+}
@@ -0,0 +1,221 @@
+use std::fs;
+
+use clap::parser::ValueSource;
+use clap::{ArgAction, ArgMatches, Command};
+
+use super::errors::ParseError;
+
+/// Command line values loaded from a TOML config file
+pub struct ConfigFile {
+    /// Flags in `--name=value` form, to be placed before the real command line so it overrides them
+    pub flags: Vec<String>,
+    pub plugin: Option<String>,
+    pub args: Vec<String>,
+}
+
+impl ConfigFile {
+    /// Load `path`, validating every key against the long flags known to `command`
+    ///
+    /// Only TOML is read, a `.yaml` or `.yml` file is refused rather than misread.
+    /// `plugin` and `args` map to the positional arguments, every other key is
+    /// the long name of a flag with either `-` or `_` as separator.
+    pub fn load(path: &str, command: &Command) -> anyhow::Result<Self> {
+        if path.ends_with(".yaml") || path.ends_with(".yml") {
+            anyhow::bail!("Config file '{}' looks like YAML, only TOML config files are supported", path);
+        }
+        let content = fs::read_to_string(path)
+            .map_err(|e| anyhow::anyhow!("Failed to read config file '{}': {}", path, e))?;
+        let table: toml::Table = content.parse().map_err(|e: toml::de::Error| ParseError {
+            path: path.to_string(),
+            line: e.span().map(|span| content[..span.start].matches('\n').count() + 1),
+            cause: e.message().to_string(),
+        })?;
+
+        let mut config = Self { flags: vec![], plugin: None, args: vec![] };
+
+        for (key, value) in table {
+            match key.as_str() {
+                "plugin" => match value {
+                    toml::Value::String(plugin) => config.plugin = Some(plugin),
+                    _ => anyhow::bail!("Key 'plugin' in config file '{}' must be a string", path),
+                },
+                "args" => config.args = string_list(path, &key, value)?,
+                _ => {
+                    let name = key.replace('_', "-");
+                    let arg = command
+                        .get_arguments()
+                        .find(|arg| arg.get_long() == Some(name.as_str()) && name != "config")
+                        .ok_or_else(|| anyhow::anyhow!("Unknown key '{}' in config file '{}'", key, path))?;
+
+                    match value {
+                        // Switches are only passed when enabled
+                        toml::Value::Boolean(enabled) if !arg.get_action().takes_values() => {
+                            if enabled {
+                                config.flags.push(format!("--{}", name));
+                            }
+                        },
+                        toml::Value::Array(_) => {
+                            for value in string_list(path, &key, value)? {
+                                config.flags.push(format!("--{}={}", name, value));
+                            }
+                        },
+                        value => config.flags.push(format!("--{}={}", name, scalar(path, &key, value)?)),
+                    }
+                },
+            }
+        }
+
+        Ok(config)
+    }
+
+    /// Drop the values of repeatable options that `given` has from the command line
+    ///
+    /// Every occurrence of such an option is collected, so the command line would add to the
+    /// config values instead of overriding them like it does for other options.
+    pub fn drop_given(&mut self, command: &Command, given: &ArgMatches) {
+        self.flags.retain(|flag| {
+            let name = flag.trim_start_matches("--").split('=').next().unwrap_or_default();
+            !command.get_arguments().any(|arg| {
+                arg.get_long() == Some(name)
+                    && matches!(arg.get_action(), ArgAction::Append)
+                    && given.value_source(arg.get_id().as_str()) == Some(ValueSource::CommandLine)
+            })
+        });
+    }
+}
+
+fn scalar(path: &str, key: &str, value: toml::Value) -> anyhow::Result<String> {
+    match value {
+        toml::Value::String(value) => Ok(value),
+        toml::Value::Integer(value) => Ok(value.to_string()),
+        toml::Value::Float(value) => Ok(value.to_string()),
+        toml::Value::Boolean(value) => Ok(value.to_string()),
+        _ => anyhow::bail!("Key '{}' in config file '{}' must be a string, number or boolean", key, path),
+    }
+}
+
+fn string_list(path: &str, key: &str, value: toml::Value) -> anyhow::Result<Vec<String>> {
+    match value {
+        toml::Value::Array(values) => values.into_iter().map(|value| scalar(path, key, value)).collect(),
+        _ => anyhow::bail!("Key '{}' in config file '{}' must be a list", key, path),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::path::PathBuf;
+
+    use clap::Arg;
+
+    use super::*;
+
+    /// A config file of its own for every test, removed again when dropped
+    struct TempConfig(PathBuf);
+
+    impl TempConfig {
+        fn new(name: &str, content: &str) -> Self {
+            let path = std::env::temp_dir().join(format!("valradar-config-{}-{}.toml", std::process::id(), name));
+            fs::write(&path, content).unwrap();
+            Self(path)
+        }
+
+        fn path(&self) -> String {
+            self.0.to_string_lossy().into_owned()
+        }
+    }
+
+    impl Drop for TempConfig {
+        fn drop(&mut self) {
+            let _ = fs::remove_file(&self.0);
+        }
+    }
+
+    const CONFIG: &str = r#"
+depth = 3
+output = ["json:config.json"]
+elasticsearch_redact = ["aws", "slack"]
+plugin = "modules.web.regex"
+args = ["https://example.com"]
+"#;
+
+    fn command() -> Command {
+        Command::new("valradar")
+            .args_override_self(true)
+            .arg(Arg::new("depth").short('d').long("depth"))
+            .arg(Arg::new("output").short('o').long("output").action(ArgAction::Append))
+            .arg(Arg::new("elasticsearch-redact").long("elasticsearch-redact").action(ArgAction::Append))
+            .arg(Arg::new("watch").long("watch").action(ArgAction::SetTrue))
+            .arg(Arg::new("config").long("config"))
+    }
+
+    /// The values of `id` after parsing the config flags followed by `cli`, like main does
+    fn parse(config: &TempConfig, cli: &[&str], id: &str) -> Vec<String> {
+        let cli = ["valradar"].iter().chain(cli).map(|arg| arg.to_string()).collect::<Vec<String>>();
+        let mut loaded = ConfigFile::load(&config.path(), &command()).unwrap();
+        loaded.drop_given(&command(), &command().try_get_matches_from(&cli).unwrap());
+
+        let argv = cli[..1].iter().chain(&loaded.flags).chain(&cli[1..]).cloned().collect::<Vec<String>>();
+        let matches = command().try_get_matches_from(argv).unwrap();
+        matches.get_many::<String>(id).map(|values| values.cloned().collect()).unwrap_or_default()
+    }
+
+    #[test]
+    fn config_values_apply_without_the_command_line() {
+        let config = TempConfig::new("defaults", CONFIG);
+        let loaded = ConfigFile::load(&config.path(), &command()).unwrap();
+        assert_eq!(loaded.plugin.as_deref(), Some("modules.web.regex"));
+        assert_eq!(loaded.args, ["https://example.com"]);
+
+        assert_eq!(parse(&config, &[], "depth"), ["3"]);
+        assert_eq!(parse(&config, &[], "output"), ["json:config.json"]);
+        assert_eq!(parse(&config, &[], "elasticsearch-redact"), ["aws", "slack"]);
+    }
+
+    #[test]
+    fn command_line_overrides_repeatable_options() {
+        let config = TempConfig::new("override", CONFIG);
+        let cli = ["-d", "5", "-o", "table", "--elasticsearch-redact", "token"];
+
+        assert_eq!(parse(&config, &cli, "depth"), ["5"]);
+        assert_eq!(parse(&config, &cli, "output"), ["table"]);
+        assert_eq!(parse(&config, &cli, "elasticsearch-redact"), ["token"]);
+    }
+
+    #[test]
+    fn repeatable_options_only_override_themselves() {
+        let config = TempConfig::new("partial", CONFIG);
+        let cli = ["-o", "table", "-o", "json:cli.json"];
+
+        assert_eq!(parse(&config, &cli, "output"), ["table", "json:cli.json"]);
+        assert_eq!(parse(&config, &cli, "elasticsearch-redact"), ["aws", "slack"]);
+    }
+
+    #[test]
+    fn switches_are_only_passed_when_enabled() {
+        let on = TempConfig::new("switch-on", "watch = true");
+        assert_eq!(ConfigFile::load(&on.path(), &command()).unwrap().flags, ["--watch"]);
+
+        let off = TempConfig::new("switch-off", "watch = false");
+        assert!(ConfigFile::load(&off.path(), &command()).unwrap().flags.is_empty());
+    }
+
+    #[test]
+    fn rejects_unknown_keys_and_yaml() {
+        let unknown = TempConfig::new("unknown", "depht = 3");
+        let error = ConfigFile::load(&unknown.path(), &command()).err().unwrap();
+        assert!(error.to_string().starts_with("Unknown key 'depht'"), "{}", error);
+
+        let nested = TempConfig::new("nested", "config = \"other.toml\"");
+        assert!(ConfigFile::load(&nested.path(), &command()).is_err());
+
+        let error = ConfigFile::load("scan.yaml", &command()).err().unwrap();
+        assert!(error.to_string().contains("only TOML config files are supported"), "{}", error);
+    }
+
+    #[test]
+    fn reports_the_line_of_a_syntax_error() {
+        let config = TempConfig::new("syntax", "depth = 3\nwatch = = true\n");
+        let error = ConfigFile::load(&config.path(), &command()).err().unwrap();
+        assert_eq!(error.downcast_ref::<ParseError>().and_then(|e| e.line), Some(2));
+    }
+}
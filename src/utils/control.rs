@@ -0,0 +1,229 @@
+use std::fs;
+use std::io::{BufRead, BufReader, ErrorKind, Write};
+use std::os::unix::fs::FileTypeExt;
+use std::os::unix::net::{UnixListener, UnixStream};
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex, MutexGuard};
+use std::thread;
+
+/// Plugin arguments as edited through the control socket
+struct ControlState {
+    args: Vec<String>,
+    rescan: bool,
+}
+
+/// A Unix socket taking line based commands that edit the arguments handed to the plugin
+///
+/// Arguments are passed through as given, so the commands work with the options of any
+/// plugin. They are split on whitespace, quotes keep spaces in one argument. Every command
+/// is answered with a line starting with `ok` or `error`:
+///
+/// - `add ARGS`: append the arguments, used from the next cycle on
+/// - `remove ARGS`: remove the first place the arguments are given in that order
+/// - `list`: one line per argument, then `ok`
+/// - `rescan`: start the next cycle now instead of waiting for `--interval`
+pub struct ControlSocket {
+    path: PathBuf,
+    state: Arc<Mutex<ControlState>>,
+}
+
+impl ControlSocket {
+    /// Listen on `path`, starting from the plugin arguments `args`
+    pub fn bind(path: &str, args: Vec<String>) -> anyhow::Result<Self> {
+        // A socket left behind by a previous run would make the bind fail, anything else at
+        // the path is left alone
+        match fs::symlink_metadata(path) {
+            Ok(metadata) if metadata.file_type().is_socket() => fs::remove_file(path)
+                .map_err(|e| anyhow::anyhow!("Failed to remove the old control socket '{}': {}", path, e))?,
+            Ok(_) => anyhow::bail!("Control socket path '{}' already exists and isn't a socket", path),
+            Err(e) if e.kind() == ErrorKind::NotFound => {},
+            Err(e) => anyhow::bail!("Failed to check control socket path '{}': {}", path, e),
+        }
+        let listener = UnixListener::bind(path)
+            .map_err(|e| anyhow::anyhow!("Failed to listen on control socket '{}': {}", path, e))?;
+
+        let state = Arc::new(Mutex::new(ControlState { args, rescan: false }));
+        let shared = state.clone();
+        thread::spawn(move || {
+            for stream in listener.incoming().flatten() {
+                let shared = shared.clone();
+                thread::spawn(move || serve(stream, &shared));
+            }
+        });
+
+        Ok(Self { path: PathBuf::from(path), state })
+    }
+
+    /// The plugin arguments with every change made so far
+    pub fn args(&self) -> Vec<String> {
+        lock(&self.state).args.clone()
+    }
+
+    /// Whether a `rescan` came in since the last call
+    pub fn take_rescan(&self) -> bool {
+        std::mem::take(&mut lock(&self.state).rescan)
+    }
+}
+
+impl Drop for ControlSocket {
+    fn drop(&mut self) {
+        let _ = fs::remove_file(&self.path);
+    }
+}
+
+/// Lock a mutex, recovering the data if a panicking thread poisoned it
+fn lock<T>(mutex: &Mutex<T>) -> MutexGuard<'_, T> {
+    mutex.lock().unwrap_or_else(|poisoned| poisoned.into_inner())
+}
+
+fn serve(stream: UnixStream, state: &Mutex<ControlState>) {
+    let Ok(mut writer) = stream.try_clone() else {
+        return;
+    };
+
+    for line in BufReader::new(stream).lines() {
+        let Ok(line) = line else {
+            return;
+        };
+        let reply = run_command(&mut lock(state), line.trim());
+        if writeln!(writer, "{}", reply).is_err() {
+            return;
+        }
+    }
+}
+
+fn run_command(state: &mut ControlState, line: &str) -> String {
+    let (command, rest) = line.split_once(' ').unwrap_or((line, ""));
+    let arguments = match split_arguments(rest) {
+        Ok(arguments) => arguments,
+        Err(e) => return format!("error {}", e),
+    };
+
+    match command {
+        "add" | "remove" if arguments.is_empty() => format!("error {} needs plugin arguments", command),
+        "add" => {
+            state.args.extend(arguments);
+            format!("ok {} arguments", state.args.len())
+        },
+        "remove" => match state.args.windows(arguments.len()).position(|window| window == arguments.as_slice()) {
+            Some(start) => {
+                state.args.drain(start..start + arguments.len());
+                format!("ok {} arguments", state.args.len())
+            },
+            None => format!("error '{}' isn't in the plugin arguments", arguments.join(" ")),
+        },
+        "list" => {
+            let mut lines = state.args.clone();
+            lines.push("ok".to_string());
+            lines.join("\n")
+        },
+        "rescan" => {
+            state.rescan = true;
+            "ok".to_string()
+        },
+        _ => format!("error unknown command '{}', expected add, remove, list or rescan", command),
+    }
+}
+
+/// Split `line` into arguments on whitespace, single or double quotes keep spaces in one
+fn split_arguments(line: &str) -> Result<Vec<String>, String> {
+    let mut arguments = vec![];
+    let mut current: Option<String> = None;
+    let mut quote = None;
+
+    for c in line.chars() {
+        match (quote, c) {
+            (Some(open), c) if c == open => quote = None,
+            (Some(_), c) => current.get_or_insert_with(String::new).push(c),
+            (None, '\'' | '"') => {
+                quote = Some(c);
+                current.get_or_insert_with(String::new);
+            },
+            (None, c) if c.is_whitespace() => arguments.extend(current.take()),
+            (None, c) => current.get_or_insert_with(String::new).push(c),
+        }
+    }
+
+    if let Some(open) = quote {
+        return Err(format!("unterminated {} quote", open));
+    }
+    arguments.extend(current);
+    Ok(arguments)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::io::Read;
+
+    use super::*;
+
+    fn state(args: &[&str]) -> ControlState {
+        ControlState { args: args.iter().map(|arg| arg.to_string()).collect(), rescan: false }
+    }
+
+    #[test]
+    fn splits_arguments_on_whitespace_and_quotes() {
+        assert_eq!(split_arguments("-t  aws=AKIA[0-9A-Z]{16}").unwrap(), vec!["-t", "aws=AKIA[0-9A-Z]{16}"]);
+        assert_eq!(split_arguments("-t 'name=a b' \"x'y\"").unwrap(), vec!["-t", "name=a b", "x'y"]);
+        assert_eq!(split_arguments("--header ''").unwrap(), vec!["--header", ""]);
+        assert!(split_arguments("").unwrap().is_empty());
+        assert_eq!(split_arguments("-t 'open").unwrap_err(), "unterminated ' quote");
+    }
+
+    #[test]
+    fn adds_and_removes_plugin_arguments() {
+        let mut state = state(&["https://example.com", "-t", "aws=AKIA"]);
+
+        assert_eq!(run_command(&mut state, "add -t 'slack=xox b'"), "ok 5 arguments");
+        assert_eq!(state.args, vec!["https://example.com", "-t", "aws=AKIA", "-t", "slack=xox b"]);
+
+        assert_eq!(run_command(&mut state, "remove -t aws=AKIA"), "ok 3 arguments");
+        assert_eq!(state.args, vec!["https://example.com", "-t", "slack=xox b"]);
+
+        assert_eq!(run_command(&mut state, "list"), "https://example.com\n-t\nslack=xox b\nok");
+    }
+
+    #[test]
+    fn rejects_missing_and_unknown_arguments() {
+        let mut state = state(&["-t", "aws=AKIA"]);
+
+        assert_eq!(run_command(&mut state, "remove -t slack=xox"), "error '-t slack=xox' isn't in the plugin arguments");
+        assert_eq!(run_command(&mut state, "add"), "error add needs plugin arguments");
+        assert_eq!(run_command(&mut state, "add -t 'x"), "error unterminated ' quote");
+        assert!(run_command(&mut state, "drop -t").starts_with("error unknown command 'drop'"));
+        assert_eq!(state.args, vec!["-t", "aws=AKIA"]);
+    }
+
+    #[test]
+    fn rescan_is_taken_once() {
+        let path = std::env::temp_dir().join(format!("valradar-control-{}-rescan.sock", std::process::id()));
+        let control = ControlSocket::bind(path.to_str().unwrap(), vec![]).unwrap();
+        assert!(!control.take_rescan());
+
+        let mut stream = UnixStream::connect(&path).unwrap();
+        stream.write_all(b"rescan\n").unwrap();
+        let mut reply = [0; 3];
+        stream.read_exact(&mut reply).unwrap();
+        assert_eq!(&reply, b"ok\n");
+
+        assert!(control.take_rescan());
+        assert!(!control.take_rescan());
+    }
+
+    #[test]
+    fn only_replaces_an_old_socket() {
+        let path = std::env::temp_dir().join(format!("valradar-control-{}-file.sock", std::process::id()));
+        fs::write(&path, "not a socket").unwrap();
+        let error = ControlSocket::bind(path.to_str().unwrap(), vec![]).err().unwrap();
+        assert!(error.to_string().contains("isn't a socket"), "{}", error);
+        assert_eq!(fs::read_to_string(&path).unwrap(), "not a socket");
+        fs::remove_file(&path).unwrap();
+
+        // A socket left behind by a run that didn't clean up is replaced
+        let stale = UnixListener::bind(&path).unwrap();
+        drop(stale);
+        let control = ControlSocket::bind(path.to_str().unwrap(), vec![]).unwrap();
+        drop(control);
+        assert!(fs::symlink_metadata(&path).is_err());
+    }
+}
@@ -0,0 +1,63 @@
+use std::time::Duration;
+
+/// Parse a human friendly duration such as `500ms`, `30s`, `30m`, `2h` or `1d`.
+/// A bare number is interpreted as seconds.
+pub fn parse_duration(value: &str) -> Result<Duration, String> {
+    let value = value.trim();
+    let split = value.find(|c: char| !c.is_ascii_digit()).unwrap_or(value.len());
+    let (number, unit) = value.split_at(split);
+
+    let number = match number.parse::<u64>() {
+        Ok(number) => number,
+        Err(_) => return Err(format!("Invalid duration: '{}'", value)),
+    };
+
+    let seconds_per_unit = match unit {
+        "ms" => return Ok(Duration::from_millis(number)),
+        "" | "s" => 1,
+        "m" => 60,
+        "h" => 60 * 60,
+        "d" => 60 * 60 * 24,
+        _ => return Err(format!("Invalid duration unit '{}' in '{}'", unit, value)),
+    };
+    number
+        .checked_mul(seconds_per_unit)
+        .map(Duration::from_secs)
+        .ok_or_else(|| format!("Duration '{}' is too long", value))
+}
+
+/// Like `parse_duration`, for options where a zero duration makes no sense, such as `--interval`
+pub fn parse_nonzero_duration(value: &str) -> Result<Duration, String> {
+    match parse_duration(value)? {
+        duration if duration.is_zero() => Err(format!("Duration '{}' must be longer than zero", value.trim())),
+        duration => Ok(duration),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_every_unit() {
+        assert_eq!(parse_duration("500ms"), Ok(Duration::from_millis(500)));
+        assert_eq!(parse_duration("30"), Ok(Duration::from_secs(30)));
+        assert_eq!(parse_duration("30m"), Ok(Duration::from_secs(30 * 60)));
+        assert_eq!(parse_duration("2h"), Ok(Duration::from_secs(2 * 60 * 60)));
+        assert_eq!(parse_duration(" 1d "), Ok(Duration::from_secs(24 * 60 * 60)));
+        assert!(parse_duration("1w").is_err());
+        assert!(parse_duration("m").is_err());
+    }
+
+    #[test]
+    fn rejects_overflowing_durations() {
+        assert_eq!(parse_duration(&format!("{}d", u64::MAX / 1000)), Err(format!("Duration '{}d' is too long", u64::MAX / 1000)));
+    }
+
+    #[test]
+    fn rejects_zero_where_it_makes_no_sense() {
+        assert_eq!(parse_duration("0s"), Ok(Duration::ZERO));
+        assert_eq!(parse_nonzero_duration("0m"), Err("Duration '0m' must be longer than zero".to_string()));
+        assert_eq!(parse_nonzero_duration("1ms"), Ok(Duration::from_millis(1)));
+    }
+}
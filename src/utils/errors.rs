@@ -0,0 +1,182 @@
+use std::fmt;
+
+/// What went wrong with a plugin hook
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum PluginErrorKind {
+    /// The plugin doesn't define the hook
+    Missing,
+    /// The hook raised a python exception, or the plugin failed to load
+    Raised,
+    /// The hook returned something else than the list or dict it has to return
+    InvalidReturn,
+}
+
+/// A plugin failed to load or one of its hooks failed
+///
+/// Like the other errors here it is found in the `anyhow::Error` the library returns with `downcast_ref`:
+///
+/// ```no_run
+/// use valradar::utils::errors::{PluginError, PluginErrorKind};
+/// # fn scan() -> anyhow::Result<()> { Ok(()) }
+///
+/// if let Err(e) = scan() {
+///     match e.downcast_ref::<PluginError>() {
+///         Some(plugin_error) if plugin_error.kind == PluginErrorKind::Raised => eprintln!("{} raised: {}", plugin_error.hook, plugin_error.cause),
+///         _ => eprintln!("{}", e),
+///     }
+/// }
+/// ```
+#[derive(Debug, Clone)]
+pub struct PluginError {
+    /// The plugin's module name, e.g. `regex`
+    pub plugin: String,
+    /// `load`, `init`, `collect_data`, `process_data`, `check` or `finish`
+    pub hook: &'static str,
+    pub kind: PluginErrorKind,
+    /// The python exception or a description of the invalid value, empty for a missing hook
+    pub cause: String,
+}
+
+impl fmt::Display for PluginError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.kind {
+            PluginErrorKind::Missing => write!(f, "Plugin '{}' has no {} function", self.plugin, self.hook),
+            PluginErrorKind::Raised => write!(f, "Plugin '{}' failed in {}: {}", self.plugin, self.hook, self.cause),
+            PluginErrorKind::InvalidReturn => write!(f, "Plugin '{}' {} returned an invalid value: {}", self.plugin, self.hook, self.cause),
+        }
+    }
+}
+
+impl std::error::Error for PluginError {}
+
+/// An HTTP request made by valradar itself failed, e.g. posting findings to `--webhook`
+#[derive(Debug, Clone)]
+pub struct FetchError {
+    pub url: String,
+    /// The response status, `None` when no response came back at all
+    pub status: Option<u16>,
+    pub cause: String,
+}
+
+impl fmt::Display for FetchError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.status {
+            Some(status) => write!(f, "Request to '{}' failed with status {}: {}", self.url, status, self.cause),
+            None => write!(f, "Request to '{}' failed: {}", self.url, self.cause),
+        }
+    }
+}
+
+impl FetchError {
+    /// The error of a failed `ureq` request to `url`
+    pub(crate) fn from_ureq(url: &str, error: ureq::Error) -> Self {
+        match error {
+            ureq::Error::Status(status, response) => Self {
+                url: url.to_string(),
+                status: Some(status),
+                cause: response.status_text().to_string(),
+            },
+            ureq::Error::Transport(transport) => Self {
+                url: url.to_string(),
+                status: None,
+                cause: transport.to_string(),
+            },
+        }
+    }
+
+    /// Whether sending the request again may help, other client errors would only be refused again
+    pub fn retryable(&self) -> bool {
+        match self.status {
+            Some(status) => status == 429 || status >= 500,
+            None => true,
+        }
+    }
+}
+
+impl std::error::Error for FetchError {}
+
+/// A file valradar reads, such as a config file or watch baseline, is unreadable or malformed
+#[derive(Debug, Clone)]
+pub struct ParseError {
+    pub path: String,
+    /// 1 based line of the problem, when the format reports one
+    pub line: Option<usize>,
+    pub cause: String,
+}
+
+impl fmt::Display for ParseError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.line {
+            Some(line) => write!(f, "Failed to parse '{}' at line {}: {}", self.path, line, self.cause),
+            None => write!(f, "Failed to parse '{}': {}", self.path, self.cause),
+        }
+    }
+}
+
+impl std::error::Error for ParseError {}
+
+/// A suggestion on how to fix `error`, for the typed errors where there is one
+pub fn hint(error: &anyhow::Error) -> Option<&'static str> {
+    if let Some(error) = error.downcast_ref::<PluginError>() {
+        return match error.kind {
+            PluginErrorKind::Raised => Some("run with --debug to see what the plugin was doing"),
+            PluginErrorKind::Missing | PluginErrorKind::InvalidReturn => Some("see 'Creating Plugins' in the README for the hooks a plugin has to provide"),
+        };
+    }
+    if let Some(error) = error.downcast_ref::<FetchError>() {
+        return match error.status {
+            Some(401) | Some(403) => Some("the server refused the request, check the credentials in the URL"),
+            Some(_) => None,
+            None => Some("check that the URL is right and the host is reachable"),
+        };
+    }
+    None
+}
+
+/// Whether the request that failed with `error` is worth sending again, see `FetchError::retryable`
+pub(crate) fn retryable(error: &anyhow::Error) -> bool {
+    error.downcast_ref::<FetchError>().is_none_or(FetchError::retryable)
+}
+
+/// `error` with its causes, followed by its hint on a second line
+pub fn describe(error: &anyhow::Error) -> String {
+    match hint(error) {
+        Some(hint) => format!("{:#}\n  hint: {}", error, hint),
+        None => format!("{:#}", error),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn failed(status: Option<u16>) -> anyhow::Error {
+        anyhow::Error::new(FetchError { url: "https://hooks.example.com".to_string(), status, cause: "failed".to_string() })
+    }
+
+    #[test]
+    fn too_many_requests_is_retried() {
+        assert!(retryable(&failed(Some(429))));
+    }
+
+    #[test]
+    fn server_errors_are_retried() {
+        for status in [500, 502, 503, 504] {
+            assert!(retryable(&failed(Some(status))), "{}", status);
+        }
+    }
+
+    #[test]
+    fn other_client_errors_are_not_retried() {
+        for status in [400, 401, 403, 404, 413, 422] {
+            assert!(!retryable(&failed(Some(status))), "{}", status);
+        }
+    }
+
+    #[test]
+    fn transport_errors_are_retried() {
+        // A request that never got a response, e.g. a refused connection or timeout
+        assert!(retryable(&failed(None)));
+        assert!(retryable(&anyhow::anyhow!("connection reset")));
+    }
+}
@@ -5,9 +5,25 @@ pub mod display;
 pub mod logging;
 pub mod module;
 pub mod license;
+pub mod duration;
+pub mod signal;
+pub mod baseline;
+pub mod webhook;
+pub mod elasticsearch;
+pub mod recover;
+pub mod config;
+pub mod output_dir;
+pub mod schema;
+pub mod errors;
+pub mod progress;
+#[cfg(unix)]
+pub mod control;
 
 // Re-export commonly used items for convenience
 pub use metadata::PluginMetadata;
 pub use context::{ExecutionContext, ProcessingResult, ProcessedData};
 pub use logging::debug;
 pub use display::print_banner;
+pub use baseline::Baseline;
+pub use config::ConfigFile;
+pub use output_dir::OutputDir;
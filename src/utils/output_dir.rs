@@ -0,0 +1,86 @@
+use std::fs;
+use std::path::PathBuf;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Environment variable telling plugins where to put the artifacts they write
+pub const OUTPUT_DIR_VAR: &str = "VALRADAR_OUTPUT_DIR";
+
+/// A timestamped directory holding everything a run produces
+///
+/// ```text
+/// <root>/<YYYYMMDDTHHMMSSZ>/
+///     run.json        the options the run was started with
+///     findings.json   the results, summary and errors (findings-N.json per watch cycle)
+///     baseline.json   the watch mode baseline, unless --baseline-file is given
+///     plugin/         artifacts written by the plugin, e.g. the regex plugin's manifest
+/// ```
+pub struct OutputDir {
+    path: PathBuf,
+    started: String,
+}
+
+impl OutputDir {
+    /// Create a new run directory under `root`, which is created too when missing
+    pub fn create(root: &str) -> anyhow::Result<Self> {
+        let started = timestamp(SystemTime::now());
+        let name = started.replace(['-', ':'], "");
+
+        // Two runs started within the same second get a numbered suffix
+        let mut path = PathBuf::from(root).join(&name);
+        let mut attempt = 1;
+        while path.exists() {
+            attempt += 1;
+            path = PathBuf::from(root).join(format!("{}-{}", name, attempt));
+        }
+
+        fs::create_dir_all(path.join("plugin"))
+            .map_err(|e| anyhow::anyhow!("Failed to create output directory '{}': {}", path.display(), e))?;
+
+        Ok(Self { path, started })
+    }
+
+    /// Path of `name` inside the run directory
+    pub fn file(&self, name: &str) -> PathBuf {
+        self.path.join(name)
+    }
+
+    /// The directory handed to the plugin through `VALRADAR_OUTPUT_DIR`
+    pub fn plugin_dir(&self) -> PathBuf {
+        self.path.join("plugin")
+    }
+
+    /// Write `run.json`, `options` is completed with the start time and valradar's version
+    pub fn write_run(&self, mut options: serde_json::Value) -> anyhow::Result<()> {
+        if let Some(run) = options.as_object_mut() {
+            run.insert("started".to_string(), self.started.clone().into());
+            run.insert("version".to_string(), env!("CARGO_PKG_VERSION").into());
+        }
+        self.write_json("run.json", &options)
+    }
+
+    /// Write a JSON document to `name` inside the run directory
+    pub fn write_json(&self, name: &str, document: &serde_json::Value) -> anyhow::Result<()> {
+        let path = self.file(name);
+        fs::write(&path, serde_json::to_string_pretty(document)?)
+            .map_err(|e| anyhow::anyhow!("Failed to write '{}': {}", path.display(), e))
+    }
+}
+
+/// `time` as an ISO 8601 UTC timestamp with second precision
+pub fn timestamp(time: SystemTime) -> String {
+    let seconds = time.duration_since(UNIX_EPOCH).map(|duration| duration.as_secs()).unwrap_or(0);
+    let (days, rest) = (seconds / 86400, seconds % 86400);
+
+    // Civil date from the days since 1970-01-01, Howard Hinnant's days_from_civil inverted
+    let z = days as i64 + 719468;
+    let era = z.div_euclid(146097);
+    let doe = z.rem_euclid(146097);
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+
+    format!("{:04}-{:02}-{:02}T{:02}:{:02}:{:02}Z", year, month, day, rest / 3600, rest % 3600 / 60, rest % 60)
+}
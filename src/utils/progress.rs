@@ -0,0 +1,21 @@
+use std::sync::Mutex;
+
+use indicatif::ProgressBar;
+
+/// The progress bar being drawn, hidden while plugins prompt on the terminal
+static ACTIVE: Mutex<Option<ProgressBar>> = Mutex::new(None);
+
+/// Make `bar` the one `suspend` hides, `None` once it is finished
+pub fn set_active(bar: Option<ProgressBar>) {
+    *ACTIVE.lock().unwrap_or_else(|poisoned| poisoned.into_inner()) = bar;
+}
+
+/// Run `f` with the active bar cleared from the terminal, it is drawn again afterwards
+pub fn suspend<R>(f: impl FnOnce() -> R) -> R {
+    // Cloned so the lock isn't held while `f` waits on the user
+    let bar = ACTIVE.lock().unwrap_or_else(|poisoned| poisoned.into_inner()).clone();
+    match bar {
+        Some(bar) => bar.suspend(f),
+        None => f(),
+    }
+}
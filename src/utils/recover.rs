@@ -0,0 +1,20 @@
+use std::any::Any;
+use std::panic::{self, AssertUnwindSafe};
+
+/// Run `routine`, converting a panic into an error so a single failure doesn't take down the process
+pub fn catch<T>(label: &str, routine: impl FnOnce() -> anyhow::Result<T>) -> anyhow::Result<T> {
+    match panic::catch_unwind(AssertUnwindSafe(routine)) {
+        Ok(result) => result,
+        Err(payload) => Err(anyhow::anyhow!("Panic in {}: {}", label, panic_message(&payload))),
+    }
+}
+
+pub fn panic_message(payload: &Box<dyn Any + Send>) -> String {
+    if let Some(message) = payload.downcast_ref::<&str>() {
+        message.to_string()
+    } else if let Some(message) = payload.downcast_ref::<String>() {
+        message.clone()
+    } else {
+        "unknown panic".to_string()
+    }
+}
@@ -0,0 +1,24 @@
+use std::io::Write;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+static SHUTDOWN: AtomicBool = AtomicBool::new(false);
+
+/// Install a SIGINT/SIGTERM handler that requests a graceful shutdown, printing `message`.
+/// A second signal exits immediately.
+pub fn install_shutdown_handler(message: &'static str) -> anyhow::Result<()> {
+    ctrlc::set_handler(move || {
+        if SHUTDOWN.swap(true, Ordering::SeqCst) {
+            // exit skips the flush a normal return from main does
+            let _ = std::io::stdout().flush();
+            std::process::exit(130);
+        }
+        println!("{}", message);
+    })?;
+
+    Ok(())
+}
+
+/// Whether a shutdown has been requested by a signal
+pub fn shutdown_requested() -> bool {
+    SHUTDOWN.load(Ordering::SeqCst)
+}
@@ -0,0 +1,253 @@
+use std::fs::OpenOptions;
+use std::io::Write;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use super::context::ProcessingResult;
+use super::errors::{FetchError, retryable};
+use super::logging::debug;
+
+/// Post findings to a webhook as a JSON document of the form `{"findings": [...]}`
+pub fn post_findings(agent: &ureq::Agent, url: &str, results: &[ProcessingResult]) -> anyhow::Result<()> {
+    let body = findings_document(results).to_string();
+
+    let response = agent.post(url)
+        .set("Content-Type", "application/json")
+        .send_string(&body);
+
+    match response {
+        Ok(_) => Ok(()),
+        Err(e) => Err(FetchError::from_ureq(url, e).into()),
+    }
+}
+
+fn findings_document(results: &[ProcessingResult]) -> serde_json::Value {
+    let findings = results
+        .iter()
+        .map(|result| result.to_json())
+        .collect::<Vec<serde_json::Value>>();
+    serde_json::json!({ "findings": findings })
+}
+
+/// Findings on their way to a webhook, posted in batches
+///
+/// Full batches are posted as soon as they are, the rest waits for `flush_interval`
+/// or `flush`. A batch that still fails after its retries is appended to the dead
+/// letter file as one `{"findings": [...]}` line, or dropped when there is none.
+pub struct WebhookSink {
+    url: String,
+    agent: ureq::Agent,
+    /// Findings per request, 0 posts everything pending in one request
+    batch_size: usize,
+    flush_interval: Duration,
+    retries: u32,
+    /// Wait before the first retry, doubled for every retry after it
+    retry_delay: Duration,
+    dead_letter: Option<String>,
+    pending: Vec<ProcessingResult>,
+    last_flush: Instant,
+}
+
+impl WebhookSink {
+    pub fn new(url: String, batch_size: usize, flush_interval: Duration, retries: u32, dead_letter: Option<String>) -> Self {
+        // A webhook that stops answering would otherwise hold up the scan loop for good
+        let agent = ureq::AgentBuilder::new()
+            .timeout_connect(Duration::from_secs(10))
+            .timeout_read(Duration::from_secs(30))
+            .timeout_write(Duration::from_secs(30))
+            .build();
+
+        Self {
+            url,
+            agent,
+            batch_size,
+            flush_interval,
+            retries,
+            retry_delay: Duration::from_secs(1),
+            dead_letter,
+            pending: vec![],
+            last_flush: Instant::now(),
+        }
+    }
+
+    /// Queue findings, posting the full batches, or everything once `flush_interval` passed since the last flush
+    pub fn push(&mut self, results: &[ProcessingResult]) -> anyhow::Result<()> {
+        self.pending.extend_from_slice(results);
+        if self.last_flush.elapsed() >= self.flush_interval {
+            return self.flush();
+        }
+
+        let full = if self.batch_size > 0 { self.pending.len() / self.batch_size * self.batch_size } else { 0 };
+        let findings = self.pending.drain(..full).collect::<Vec<ProcessingResult>>();
+        self.send(&findings)
+    }
+
+    /// Post everything still pending
+    pub fn flush(&mut self) -> anyhow::Result<()> {
+        self.last_flush = Instant::now();
+        let findings = std::mem::take(&mut self.pending);
+        self.send(&findings)
+    }
+
+    /// Findings queued and not posted yet
+    pub fn pending(&self) -> usize {
+        self.pending.len()
+    }
+
+    fn send(&self, findings: &[ProcessingResult]) -> anyhow::Result<()> {
+        if findings.is_empty() {
+            return Ok(());
+        }
+
+        let batch_size = if self.batch_size > 0 { self.batch_size } else { findings.len() };
+        let batches = findings.len().div_ceil(batch_size);
+        let mut failed = 0;
+        let mut last_error = None;
+        for batch in findings.chunks(batch_size) {
+            let Err(e) = self.post_with_retries(batch) else {
+                continue;
+            };
+            failed += 1;
+            last_error = Some(match &self.dead_letter {
+                Some(path) => match append_dead_letter(path, batch) {
+                    Ok(()) => e.context(format!("batch of {} findings written to '{}'", batch.len(), path)),
+                    Err(write_error) => write_error.context(format!("batch of {} findings lost", batch.len())),
+                },
+                None => e.context(format!("batch of {} findings dropped", batch.len())),
+            });
+        }
+
+        match last_error {
+            Some(e) => Err(e.context(format!("{} of {} webhook batches failed", failed, batches))),
+            None => Ok(()),
+        }
+    }
+
+    fn post_with_retries(&self, batch: &[ProcessingResult]) -> anyhow::Result<()> {
+        let mut delay = self.retry_delay;
+        let mut attempt = 0;
+        loop {
+            match post_findings(&self.agent, &self.url, batch) {
+                Ok(()) => return Ok(()),
+                Err(e) if attempt < self.retries && retryable(&e) => {
+                    debug(&format!("Webhook post failed, retrying in {:?}: {}", delay, e));
+                    thread::sleep(delay);
+                    delay *= 2;
+                    attempt += 1;
+                },
+                Err(e) => return Err(e),
+            }
+        }
+    }
+}
+
+fn append_dead_letter(path: &str, batch: &[ProcessingResult]) -> anyhow::Result<()> {
+    let mut file = OpenOptions::new().create(true).append(true).open(path)
+        .map_err(|e| anyhow::anyhow!("Failed to open dead letter file '{}': {}", path, e))?;
+    writeln!(file, "{}", findings_document(batch))
+        .map_err(|e| anyhow::anyhow!("Failed to write dead letter file '{}': {}", path, e))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs;
+    use std::io::{BufRead, BufReader, Read};
+    use std::net::TcpListener;
+
+    use super::*;
+
+    /// A webhook on a local port answering one request with each of `statuses` in turn,
+    /// joining the handle gives the bodies it was sent
+    fn webhook(statuses: &[u16]) -> (String, thread::JoinHandle<Vec<String>>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}/hook", listener.local_addr().unwrap());
+        let statuses = statuses.to_vec();
+
+        let handle = thread::spawn(move || {
+            let mut bodies = vec![];
+            for status in statuses {
+                let (stream, _) = listener.accept().unwrap();
+                let mut reader = BufReader::new(stream.try_clone().unwrap());
+                let mut length = 0;
+                loop {
+                    let mut line = String::new();
+                    reader.read_line(&mut line).unwrap();
+                    if line.trim().is_empty() {
+                        break;
+                    }
+                    if let Some((name, value)) = line.split_once(':') {
+                        if name.eq_ignore_ascii_case("content-length") {
+                            length = value.trim().parse().unwrap();
+                        }
+                    }
+                }
+                let mut body = vec![0; length];
+                reader.read_exact(&mut body).unwrap();
+                bodies.push(String::from_utf8(body).unwrap());
+
+                let mut stream = stream;
+                write!(stream, "HTTP/1.1 {} Status\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status).unwrap();
+            }
+            bodies
+        });
+
+        (url, handle)
+    }
+
+    fn findings(count: usize) -> Vec<ProcessingResult> {
+        (0..count)
+            .map(|i| ProcessingResult::new(vec!["url".to_string()], vec![format!("https://example.com/{}", i)]))
+            .collect()
+    }
+
+    fn batch_sizes(bodies: &[String]) -> Vec<usize> {
+        bodies
+            .iter()
+            .map(|body| serde_json::from_str::<serde_json::Value>(body).unwrap()["findings"].as_array().unwrap().len())
+            .collect()
+    }
+
+    #[test]
+    fn posts_full_batches_and_keeps_the_rest() {
+        let (url, webhook) = webhook(&[200, 200, 200]);
+        let mut sink = WebhookSink::new(url, 2, Duration::from_secs(3600), 0, None);
+
+        sink.push(&findings(5)).unwrap();
+        assert_eq!(sink.pending(), 1);
+        sink.flush().unwrap();
+        assert_eq!(sink.pending(), 0);
+
+        assert_eq!(batch_sizes(&webhook.join().unwrap()), vec![2, 2, 1]);
+    }
+
+    #[test]
+    fn retries_until_the_webhook_takes_the_batch() {
+        let (url, webhook) = webhook(&[503, 429, 200]);
+        let mut sink = WebhookSink::new(url, 0, Duration::ZERO, 2, None);
+        sink.retry_delay = Duration::from_millis(10);
+
+        sink.push(&findings(3)).unwrap();
+
+        let bodies = webhook.join().unwrap();
+        assert_eq!(batch_sizes(&bodies), vec![3, 3, 3]);
+        assert!(bodies.windows(2).all(|pair| pair[0] == pair[1]));
+    }
+
+    #[test]
+    fn failed_batches_go_to_the_dead_letter_file() {
+        let path = std::env::temp_dir().join(format!("valradar-webhook-{}-dead-letter.jsonl", std::process::id()));
+        let _ = fs::remove_file(&path);
+        let (url, webhook) = webhook(&[503, 503, 400]);
+        let mut sink = WebhookSink::new(url, 2, Duration::from_secs(3600), 1, Some(path.to_string_lossy().into_owned()));
+        sink.retry_delay = Duration::from_millis(10);
+
+        // The first batch fails twice, the second is refused and not sent again
+        let error = sink.push(&findings(4)).unwrap_err();
+        assert!(format!("{:#}", error).starts_with("2 of 2 webhook batches failed"), "{:#}", error);
+        assert_eq!(batch_sizes(&webhook.join().unwrap()), vec![2, 2, 2]);
+
+        let lines = fs::read_to_string(&path).unwrap().lines().map(str::to_string).collect::<Vec<String>>();
+        fs::remove_file(&path).unwrap();
+        assert_eq!(batch_sizes(&lines), vec![2, 2]);
+    }
+}
@@ -0,0 +1,124 @@
+"""Run plugins the way valradar does, against local servers, without the Rust core
+
+    python3 -m unittest discover tests
+"""
+import functools
+import http.server
+import importlib.util
+import os
+import sys
+import tempfile
+import threading
+import time
+import unittest
+from concurrent.futures import ThreadPoolExecutor
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+
+def require(name):
+    """Import name, skipping the calling tests when it isn't installed"""
+    try:
+        return importlib.import_module(name)
+    except ImportError:
+        raise unittest.SkipTest("%s isn't installed" % name)
+
+def load_plugin(relative_path, name):
+    """Load a plugin from its file, registered in sys.modules under name like valradar does
+
+    Tests are skipped when a module the plugin imports, such as requests, isn't installed.
+    """
+    spec = importlib.util.spec_from_file_location(name, os.path.join(ROOT, relative_path))
+    module = importlib.util.module_from_spec(spec)
+    sys.modules[name] = module
+    try:
+        spec.loader.exec_module(module)
+    except ModuleNotFoundError as e:
+        del sys.modules[name]
+        raise unittest.SkipTest("%s needs %s, which isn't installed" % (relative_path, e.name))
+    return module
+
+def execute_again(module):
+    """Execute the module again in its own namespace, which resets its module level state"""
+    with open(module.__file__) as f:
+        exec(compile(f.read(), module.__file__, "exec"), module.__dict__)
+
+def crawl(plugin, args, depth=1, between_hooks=None, workers=1):
+    """init, collect depth times and process, returning the processed rows and every context
+
+    between_hooks is called before every collect and process call, workers collect at once
+    like valradar's -c.
+    """
+    config = plugin.VALRADAR_CONFIG
+
+    def collect(context):
+        if between_hooks:
+            between_hooks()
+        return config["collect_data"](context)
+
+    queue = config["init"](args)
+    contexts = list(queue)
+    with ThreadPoolExecutor(workers) as pool:
+        for _ in range(depth):
+            queue = [child for children in pool.map(collect, queue) for child in children]
+            contexts.extend(queue)
+
+    rows = []
+    for context in contexts:
+        if between_hooks:
+            between_hooks()
+        row = config["process_data"](context)
+        if row is not None:
+            rows.append(row)
+    return rows, contexts
+
+class Site:
+    """Files served over HTTP on a free local port, with the paths and headers requested
+
+    Every response takes delay seconds, most_in_flight is the most requests served at once.
+    content_types maps extensions such as ".html" to the Content-Type they are served with.
+    """
+
+    def __init__(self, files, delay=0, content_types=None):
+        self.directory = tempfile.TemporaryDirectory()
+        for name, content in files.items():
+            path = os.path.join(self.directory.name, name)
+            os.makedirs(os.path.dirname(path), exist_ok=True)
+            with open(path, "w") as f:
+                f.write(content)
+
+        self.requested = []
+        self.headers = []
+        self.in_flight = 0
+        self.most_in_flight = 0
+        lock = threading.Lock()
+        site = self
+
+        class Handler(http.server.SimpleHTTPRequestHandler):
+            extensions_map = dict(http.server.SimpleHTTPRequestHandler.extensions_map, **(content_types or {}))
+
+            def do_GET(self):
+                site.requested.append(self.path)
+                site.headers.append(self.headers)
+                with lock:
+                    site.in_flight += 1
+                    site.most_in_flight = max(site.most_in_flight, site.in_flight)
+                try:
+                    time.sleep(delay)
+                    super().do_GET()
+                finally:
+                    with lock:
+                        site.in_flight -= 1
+
+            def log_message(self, *args):
+                pass
+
+        self.server = http.server.ThreadingHTTPServer(("127.0.0.1", 0), functools.partial(Handler, directory=self.directory.name))
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def url(self, path=""):
+        return "http://127.0.0.1:%d/%s" % (self.server.server_address[1], path)
+
+    def close(self):
+        self.server.shutdown()
+        self.server.server_close()
+        self.directory.cleanup()
@@ -0,0 +1,25 @@
+import unittest
+
+from helpers import Site, crawl, load_plugin
+
+PAGES = {
+    "index.html": "<html><body>key=AKIA0123456789 key=AKIA01234567890123456789</body></html>",
+}
+PATTERN = ["-t", "aws=AKIA[0-9]+"]
+
+class MatchLengthTest(unittest.TestCase):
+    def setUp(self):
+        self.plugin = load_plugin("modules/web/regex.py", "regex_match_length_test")
+        self.site = Site(PAGES)
+        self.addCleanup(self.site.close)
+
+    def test_long_matches_are_dropped(self):
+        rows, _ = crawl(self.plugin, [self.site.url("index.html"), "--drop-matches-over", "16"] + PATTERN)
+        self.assertEqual([row["aws"] for row in rows], ["AKIA0123456789"])
+
+    def test_long_matches_can_be_truncated(self):
+        rows, _ = crawl(self.plugin, [self.site.url("index.html"), "--drop-matches-over", "16", "--truncate-long-matches"] + PATTERN)
+        self.assertEqual([row["aws"] for row in rows], ["AKIA0123456789, AKIA012345678901...[+8 chars]"])
+
+if __name__ == "__main__":
+    unittest.main()
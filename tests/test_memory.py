@@ -0,0 +1,34 @@
+import builtins
+import contextlib
+import io
+import sys
+import unittest
+from unittest import mock
+
+from helpers import load_plugin
+
+def without_proc(path, *args, **kwargs):
+    if path.startswith("/proc/"):
+        raise FileNotFoundError(path)
+    return open(path, *args, **kwargs)
+
+class ResidentMemoryTest(unittest.TestCase):
+    def setUp(self):
+        self.plugin = load_plugin("modules/web/regex.py", "regex_memory_test")
+
+    def test_proc(self):
+        self.assertGreater(self.plugin.resident_memory(), 0)
+
+    def test_without_proc_or_resource(self):
+        # Like Windows, neither /proc nor the resource module exists
+        with mock.patch.object(builtins, "open", without_proc), mock.patch.dict(sys.modules, {"resource": None}):
+            self.assertIsNone(self.plugin.resident_memory())
+            with self.assertRaises(SystemExit), contextlib.redirect_stderr(io.StringIO()):
+                self.plugin.VALRADAR_CONFIG["init"](["https://example.test/", "-t", "a", "--max-memory", "100"])
+
+    def test_without_proc(self):
+        with mock.patch.object(builtins, "open", without_proc):
+            self.assertGreater(self.plugin.resident_memory(), 0)
+
+if __name__ == "__main__":
+    unittest.main()